@@ -0,0 +1,302 @@
+package coco
+
+import (
+	"expvar"
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// How many intervals a host's latest sample is rolled up for, so hosts whose
+// samples arrive just after an interval ends aren't left out of it
+const aggregateStaleIntervals = 3
+
+// Samples added to aggregation rules, and synthetic samples emitted by them
+var aggregateCounts = expvar.NewMap("coco.aggregate")
+
+// AggregateConfig describes a rule that rolls up metrics across hosts. Every
+// interval, the latest value of each metric from every host matching Host,
+// and plugin matching Plugin if it's set, are combined by Function and
+// emitted as a sample from Hostname.
+type AggregateConfig struct {
+	Hostname     string
+	Host         string
+	Plugin       string
+	Function     string
+	TickInterval Duration `toml:"interval"`
+}
+
+// Helper function to provide a default interval value
+func (a *AggregateConfig) Interval() time.Duration {
+	if a.TickInterval.Duration == 0 {
+		return 10 * time.Second
+	} else {
+		return a.TickInterval.Duration
+	}
+}
+
+// Validate checks the rule is complete and its patterns compile
+func (a *AggregateConfig) Validate() error {
+	if len(a.Hostname) == 0 {
+		return fmt.Errorf("aggregate rule for hosts '%s' has no hostname", a.Host)
+	}
+	if len(a.Host) == 0 {
+		return fmt.Errorf("aggregate rule %s has no host pattern", a.Hostname)
+	}
+	if _, err := regexp.Compile(a.Host); err != nil {
+		return fmt.Errorf("invalid host pattern in aggregate rule %s: %s", a.Hostname, err)
+	}
+	if _, err := regexp.Compile(a.Plugin); err != nil {
+		return fmt.Errorf("invalid plugin pattern in aggregate rule %s: %s", a.Hostname, err)
+	}
+	switch a.Function {
+	case "", AggregateSum, AggregateAverage:
+	default:
+		return fmt.Errorf("unknown function '%s' in aggregate rule %s", a.Function, a.Hostname)
+	}
+	if a.TickInterval.Duration < 0 {
+		return fmt.Errorf("invalid interval %s in aggregate rule %s", a.TickInterval.Duration, a.Hostname)
+	}
+	return nil
+}
+
+// hostSample is the latest sample from a host, when it was added, and how
+// much its counters have increased since the rule last emitted
+type hostSample struct {
+	packet collectd.Packet
+	seen   time.Time
+	// Increase in each counter, derive, and absolute value
+	increases []float64
+	// Whether any increases have been recorded, which needs a previous
+	// sample for counters and derives
+	increased bool
+}
+
+// aggregation is a rule's compiled patterns, the latest sample it has matched
+// from each host, and the running totals of counters it has emitted
+type aggregation struct {
+	config AggregateConfig
+	host   *regexp.Regexp
+	plugin *regexp.Regexp
+
+	lock sync.Mutex
+	// map[metric name]map[sample host]latest sample
+	latest map[string]map[string]*hostSample
+	// map[metric name]running total of each value
+	totals map[string][]float64
+}
+
+// Aggregator applies aggregation rules to samples accepted by Filter
+type Aggregator struct {
+	rules []*aggregation
+}
+
+// NewAggregator validates and sets up aggregation rules
+func NewAggregator(configs []AggregateConfig) (*Aggregator, error) {
+	aggregateCounts.Add("samples", 0)
+	aggregateCounts.Add("emitted", 0)
+	aggregateCounts.Add("empty", 0)
+	errorCounts.Add("aggregate.mismatch", 0)
+
+	a := &Aggregator{}
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		rule := &aggregation{
+			config: config,
+			host:   regexp.MustCompile(config.Host),
+			latest: make(map[string]map[string]*hostSample),
+			totals: make(map[string][]float64),
+		}
+		if len(config.Plugin) > 0 {
+			rule.plugin = regexp.MustCompile(config.Plugin)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+// Add records a sample for every rule it matches
+func (a *Aggregator) Add(packet collectd.Packet) {
+	if a == nil {
+		return
+	}
+	for _, rule := range a.rules {
+		if !rule.host.MatchString(packet.Hostname) {
+			continue
+		}
+		if rule.plugin != nil && !rule.plugin.MatchString(packet.Plugin) {
+			continue
+		}
+		name := MetricName(packet)
+		now := time.Now()
+		rule.lock.Lock()
+		if rule.latest[name] == nil {
+			rule.latest[name] = make(map[string]*hostSample)
+		}
+		rule.latest[name][packet.Hostname] = record(rule.latest[name][packet.Hostname], packet, now)
+		rule.lock.Unlock()
+		aggregateCounts.Add("samples", 1)
+	}
+}
+
+// record adds a sample to a host's previous sample. Counters and derives are
+// cumulative, so only how much they've increased since the previous sample is
+// added up. A host's first sample is the baseline for its counters, so a host
+// joining doesn't add its whole count, and a counter that has gone down has
+// been reset, e.g. because the host restarted, so it becomes the new baseline.
+// Absolute values are reset every time they're sent, so they're added as is.
+func record(s *hostSample, packet collectd.Packet, now time.Time) *hostSample {
+	first := s == nil || !sameLayout(s.packet, packet)
+	if first {
+		s = &hostSample{increases: make([]float64, len(packet.Values))}
+	}
+	for i, v := range packet.Values {
+		if v.Type == collectd.TypeGauge || math.IsNaN(v.Value) {
+			continue
+		}
+		switch {
+		case v.Type == collectd.TypeAbsolute:
+			s.increases[i] += v.Value
+		case first:
+			continue
+		case v.Value >= s.packet.Values[i].Value:
+			s.increases[i] += v.Value - s.packet.Values[i].Value
+		}
+		s.increased = true
+	}
+	s.packet = packet
+	s.seen = now
+	return s
+}
+
+// Aggregate emits the samples rolled up by every rule onto the filtered queue,
+// so they are sent like any other sample
+func Aggregate(aggregator *Aggregator, queue QueueConfig, filtered chan collectd.Packet) {
+	if aggregator == nil || len(aggregator.rules) == 0 {
+		return
+	}
+	for _, rule := range aggregator.rules[1:] {
+		go rule.run(queue, filtered)
+	}
+	aggregator.rules[0].run(queue, filtered)
+}
+
+// run emits a rule's samples every interval
+func (r *aggregation) run(queue QueueConfig, filtered chan collectd.Packet) {
+	ticker := time.NewTicker(r.config.Interval())
+	for now := range ticker.C {
+		for _, packet := range r.emit(now) {
+			enqueue("filtered", queue, filtered, packet)
+			aggregateCounts.Add("emitted", 1)
+		}
+	}
+}
+
+// emit combines the latest sample from each host into one sample per metric,
+// and forgets hosts whose samples are stale. Gauges are combined from each
+// host's latest value. Counters, derives, and absolutes are combined from how
+// much they've increased on each host since the last emit, and are emitted as
+// a derive of their running total, so hosts joining and leaving don't make
+// the total jump. Metrics without any values to combine aren't emitted.
+func (r *aggregation) emit(now time.Time) []collectd.Packet {
+	cutoff := now.Add(-aggregateStaleIntervals * r.config.Interval())
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var packets []collectd.Packet
+	for name, hosts := range r.latest {
+		var packet collectd.Packet
+		var counts []int
+		for host, s := range hosts {
+			if s.seen.Before(cutoff) {
+				delete(hosts, host)
+				continue
+			}
+			p := s.packet
+			if counts == nil {
+				packet = collectd.Packet{
+					Hostname:       r.config.Hostname,
+					Plugin:         p.Plugin,
+					PluginInstance: p.PluginInstance,
+					Type:           p.Type,
+					TypeInstance:   p.TypeInstance,
+					Time:           uint64(now.Unix()),
+					Interval:       uint64(r.config.Interval().Seconds()),
+					Values:         make([]collectd.Value, len(p.Values)),
+				}
+				for i, v := range p.Values {
+					packet.Values[i] = collectd.Value{Name: v.Name, Type: v.Type, TypeName: v.TypeName}
+				}
+				counts = make([]int, len(p.Values))
+			}
+			// Hosts can disagree on a type's values if their types.db differ
+			if !sameLayout(packet, p) {
+				errorCounts.Add("aggregate.mismatch", 1)
+				continue
+			}
+			for i, v := range p.Values {
+				if v.Type != collectd.TypeGauge {
+					if s.increased {
+						packet.Values[i].Value += s.increases[i]
+						counts[i] += 1
+					}
+					s.increases[i] = 0
+					continue
+				}
+				if math.IsNaN(v.Value) {
+					continue
+				}
+				packet.Values[i].Value += v.Value
+				counts[i] += 1
+			}
+			s.increased = false
+		}
+		// Forget metrics no host has sent for a while, so rules matching
+		// short-lived metrics don't grow forever
+		if len(hosts) == 0 {
+			delete(r.latest, name)
+			delete(r.totals, name)
+			continue
+		}
+
+		// Every host's gauges were NaN, and no host's counters have a
+		// previous sample to have increased from, so there's nothing to
+		// combine
+		empty := true
+		for _, c := range counts {
+			if c > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			aggregateCounts.Add("empty", 1)
+			continue
+		}
+
+		totals := r.totals[name]
+		if len(totals) != len(packet.Values) {
+			totals = make([]float64, len(packet.Values))
+			r.totals[name] = totals
+		}
+		for i, v := range packet.Values {
+			if counts[i] == 0 && v.Type == collectd.TypeGauge {
+				packet.Values[i].Value = math.NaN()
+			} else if counts[i] > 0 && r.config.Function == AggregateAverage {
+				packet.Values[i].Value /= float64(counts[i])
+			}
+			if v.Type != collectd.TypeGauge {
+				totals[i] += packet.Values[i].Value
+				packet.Values[i].Value = totals[i]
+				packet.Values[i].Type = collectd.TypeDerive
+				packet.Values[i].TypeName = collectd.ValueTypeValues[collectd.TypeDerive]
+			}
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,159 @@
+package coco
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// BatchConfig describes how samples are batched into datagrams for a tier's
+// targets. If MaxPacketSize is 0, each sample is sent in its own datagram.
+type BatchConfig struct {
+	MaxPacketSize int
+	FlushInterval Duration
+}
+
+// Helper function to provide a default flush interval
+func (b *BatchConfig) Interval() time.Duration {
+	if b.FlushInterval.Duration == 0 {
+		return time.Second
+	} else {
+		return b.FlushInterval.Duration
+	}
+}
+
+// batch accumulates encoded samples for a target until they fill a datagram.
+// It is locked, as every Send worker queues samples on it.
+type batch struct {
+	lock    sync.Mutex
+	buf     []byte
+	samples int64
+}
+
+// buildBatches sets up a batch for every target in a tier, if batching is
+// enabled.
+func buildBatches(tier *Tier) {
+	if tier.Batch.MaxPacketSize <= 0 {
+		return
+	}
+	if tier.Batch.MaxPacketSize > maxDatagramSize {
+		log.Fatalf("[fatal] BuildTiers: max_packet_size %d is larger than a UDP datagram (%d bytes) in tier '%s'", tier.Batch.MaxPacketSize, maxDatagramSize, tier.Name)
+	}
+	tier.batches = make(map[string]*batch)
+	for _, t := range tier.Targets {
+		tier.batches[t] = &batch{buf: make([]byte, 0, tier.Batch.MaxPacketSize)}
+	}
+}
+
+// flushInterval determines how often batches need to be flushed across all
+// tiers. It is 0 if no tier batches samples.
+func flushInterval(tiers *[]Tier) time.Duration {
+	var interval time.Duration
+	for _, tier := range *tiers {
+		if tier.batches == nil {
+			continue
+		}
+		if i := tier.Batch.Interval(); interval == 0 || i < interval {
+			interval = i
+		}
+	}
+	return interval
+}
+
+// queue adds an encoded sample to a target's batch, dispatching the batch
+// first if the sample won't fit in it. Samples are dispatched immediately if
+// the tier doesn't batch.
+func (t *Tier) queue(target string, payload []byte) {
+	b := t.batches[target]
+	if b == nil {
+		t.dispatch(target, payload, 1)
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.buf)+len(payload) > t.Batch.MaxPacketSize {
+		t.flushBatch(target, b)
+	}
+	// A sample larger than a datagram can only be sent on its own
+	if len(payload) > t.Batch.MaxPacketSize {
+		errorCounts.Add("send.oversize", 1)
+		t.dispatch(target, payload, 1)
+		return
+	}
+	b.buf = append(b.buf, payload...)
+	b.samples += 1
+}
+
+// flush dispatches whatever is in a target's batch
+func (t *Tier) flush(target string) {
+	b := t.batches[target]
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t.flushBatch(target, b)
+}
+
+// flushBatch dispatches whatever is in a batch. Must be called with the
+// batch's lock held.
+func (t *Tier) flushBatch(target string, b *batch) {
+	if b.samples == 0 {
+		return
+	}
+	// The datagram is copied, because it may be spilled
+	payload := make([]byte, len(b.buf))
+	copy(payload, b.buf)
+	t.dispatch(target, payload, b.samples)
+	b.buf = b.buf[:0]
+	b.samples = 0
+}
+
+// flushAll dispatches whatever is in every target's batch
+func (t *Tier) flushAll() {
+	for target, _ := range t.batches {
+		t.flush(target)
+	}
+}
+
+// dispatch writes a datagram of encoded samples to a target, spilling it if
+// the target can't be written to. It returns whether the datagram was written.
+func (t *Tier) dispatch(target string, payload []byte, samples int64) bool {
+	spool := t.Spools[target]
+	if spool != nil && spool.Spilling() {
+		// Keep spilling while the target is down. Spool retries the target
+		// periodically.
+		if spool.Append(payload) {
+			sendCounts.Add("spilled", samples)
+		}
+		return false
+	}
+	conn := t.Connections[target]
+	if conn == nil && spool != nil {
+		conn = spool.Conn()
+	}
+	if conn == nil {
+		errorCounts.Add("send.disconnected", 1)
+		if spool != nil && spool.Append(payload) {
+			sendCounts.Add("spilled", samples)
+		}
+		return false
+	}
+
+	_, err := conn.Write(payload)
+	if err != nil {
+		// Increment counter, but don't log because that will fill up the disk
+		// when a storage target goes away during a network partition.
+		errorCounts.Add("send.write", 1)
+		if spool != nil && spool.Append(payload) {
+			sendCounts.Add("spilled", samples)
+		}
+		return false
+	}
+
+	// Update counters. The hash counters are updated as samples are routed.
+	sendCounts.Add(target, samples)
+	sendCounts.Add("total", samples)
+	sendCounts.Add("datagrams", 1)
+	return true
+}
@@ -0,0 +1,154 @@
+package coco
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultCardinalityTop = 10
+
+// New metrics seen for hosts over the limit, and how many were rejected
+var cardinalityCounts = expvar.NewMap("coco.cardinality")
+
+// CardinalityConfig limits how many distinct metrics are routed per host. If
+// MaxMetricsPerHost is 0, there is no limit. Hosts over the limit are logged,
+// and their new metrics are rejected if Reject is set.
+type CardinalityConfig struct {
+	MaxMetricsPerHost int `toml:"max_metrics_per_host"`
+	Reject            bool
+}
+
+// Validate checks the limit is sane
+func (c *CardinalityConfig) Validate() error {
+	if c.MaxMetricsPerHost < 0 {
+		return fmt.Errorf("invalid max_metrics_per_host %d", c.MaxMetricsPerHost)
+	}
+	return nil
+}
+
+// admit determines if a metric for a host can be routed to a target, based on
+// how many metrics are already routed for the host. Metrics that have already
+// been routed are always admitted. Must be called with routesLock held.
+func (t *Tier) admit(target string, host string, name string) bool {
+	limit := t.Cardinality.MaxMetricsPerHost
+	metrics := t.Mappings[target][host]
+	if _, ok := metrics[name]; ok || limit == 0 {
+		return true
+	}
+	if t.overLimit == nil {
+		t.overLimit = make(map[string]bool)
+	}
+	if len(metrics) < limit {
+		delete(t.overLimit, host)
+		return true
+	}
+
+	cardinalityCounts.Add("exceeded", 1)
+	if !t.overLimit[host] {
+		log.Printf("[warning] Send: %s has reached the limit of %d metrics in tier %s, see /cardinality", host, limit, t.Name)
+		t.overLimit[host] = true
+	}
+	if t.Cardinality.Reject {
+		cardinalityCounts.Add("rejected", 1)
+		return false
+	}
+	return true
+}
+
+// HostCardinality describes how many metrics Coco has routed for a host
+type HostCardinality struct {
+	Host    string `json:"host"`
+	Metrics int    `json:"metrics"`
+	AtLimit bool   `json:"at_limit,omitempty"`
+}
+
+// PluginCardinality describes how many metrics Coco has routed for a plugin,
+// across all hosts
+type PluginCardinality struct {
+	Plugin  string `json:"plugin"`
+	Metrics int    `json:"metrics"`
+	Hosts   int    `json:"hosts"`
+}
+
+type CardinalityJSON struct {
+	MaxMetricsPerHost int                 `json:"max_metrics_per_host"`
+	Hosts             []HostCardinality   `json:"hosts"`
+	Plugins           []PluginCardinality `json:"plugins"`
+}
+
+// Cardinality ranks the hosts and plugins with the most metrics. The number
+// of each returned is set with the top parameter.
+func Cardinality(req *http.Request, tiers *[]Tier) (int, []byte) {
+	top := defaultCardinalityTop
+	if v := req.URL.Query().Get("top"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid top '%s', must be between 1 and %d", v, maxPageLimit))
+		}
+		top = n
+	}
+
+	result := CardinalityJSON{Hosts: []HostCardinality{}, Plugins: []PluginCardinality{}}
+	if len(*tiers) > 0 {
+		result.MaxMetricsPerHost = (*tiers)[0].Cardinality.MaxMetricsPerHost
+	}
+
+	seen, _ := routes(tiers)
+	plugins := map[string]*PluginCardinality{}
+	for host, metrics := range seen {
+		h := HostCardinality{Host: host, Metrics: len(metrics)}
+		h.AtLimit = result.MaxMetricsPerHost > 0 && h.Metrics >= result.MaxMetricsPerHost
+		result.Hosts = append(result.Hosts, h)
+
+		hostPlugins := map[string]bool{}
+		for name := range metrics {
+			plugin := strings.SplitN(name, "/", 2)[0]
+			if plugins[plugin] == nil {
+				plugins[plugin] = &PluginCardinality{Plugin: plugin}
+			}
+			plugins[plugin].Metrics += 1
+			hostPlugins[plugin] = true
+		}
+		for plugin := range hostPlugins {
+			plugins[plugin].Hosts += 1
+		}
+	}
+	for _, p := range plugins {
+		result.Plugins = append(result.Plugins, *p)
+	}
+
+	sort.Sort(byHostCardinality(result.Hosts))
+	sort.Sort(byPluginCardinality(result.Plugins))
+	if len(result.Hosts) > top {
+		result.Hosts = result.Hosts[:top]
+	}
+	if len(result.Plugins) > top {
+		result.Plugins = result.Plugins[:top]
+	}
+
+	data, _ := json.Marshal(result)
+	return http.StatusOK, data
+}
+
+// Sort by most metrics first, then alphabetically
+type byHostCardinality []HostCardinality
+
+func (h byHostCardinality) Len() int      { return len(h) }
+func (h byHostCardinality) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h byHostCardinality) Less(i, j int) bool {
+	return h[i].Metrics > h[j].Metrics || (h[i].Metrics == h[j].Metrics && h[i].Host < h[j].Host)
+}
+
+type byPluginCardinality []PluginCardinality
+
+func (p byPluginCardinality) Len() int      { return len(p) }
+func (p byPluginCardinality) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPluginCardinality) Less(i, j int) bool {
+	return p[i].Metrics > p[j].Metrics || (p[i].Metrics == p[j].Metrics && p[i].Plugin < p[j].Plugin)
+}
@@ -1,7 +1,6 @@
 package coco
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/json"
 	"expvar"
@@ -10,11 +9,13 @@ import (
 	collectd "github.com/kimor79/gollectd"
 	consistent "github.com/stathat/consistent"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -52,6 +53,9 @@ func determineProperties(sizes []int) *expvar.Map {
 
 // calculateTargetSummaryStats builds per-tier, per-target, metric-to-host summary stats
 func calculateTargetSummaryStats(tiers *[]Tier) {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
 	for _, tier := range *tiers {
 		totalSizes := []int{}
 		tierStats := new(expvar.Map).Init()
@@ -77,9 +81,16 @@ func calculateTargetSummaryStats(tiers *[]Tier) {
 
 func Measure(config MeasureConfig, chans map[string]chan collectd.Packet, tiers *[]Tier) {
 	tick := time.NewTicker(config.Interval()).C
+	drops := map[string]int64{}
 	for n, _ := range chans {
 		log.Println("[info] Measure: measuring queue", n)
 		queueCounts.Set(n, &expvar.Int{})
+		dropCounts.Add(n, 0)
+		drops[n] = dropped(n)
+	}
+	for _, n := range queueNames {
+		dropCounts.Add(n, 0)
+		drops[n] = dropped(n)
 	}
 	for {
 		select {
@@ -89,6 +100,18 @@ func Measure(config MeasureConfig, chans map[string]chan collectd.Packet, tiers
 				queueCounts.Get(n).(*expvar.Int).Set(int64(len(c)))
 			}
 
+			// Samples dropped because queues were full
+			for n, _ := range drops {
+				d := dropped(n)
+				if d > drops[n] {
+					log.Printf("[warning] Measure: dropped %d samples from full queue %s", d-drops[n], n)
+				}
+				drops[n] = d
+			}
+
+			// Samples per second processed by each worker
+			measureThroughput(config.Interval())
+
 			// Per-tier, per-target, metric-to-host summary stats
 			calculateTargetSummaryStats(tiers)
 		}
@@ -99,28 +122,79 @@ func Measure(config MeasureConfig, chans map[string]chan collectd.Packet, tiers
 func Listen(config ListenConfig, c chan collectd.Packet) {
 	// Initialise the error counts
 	errorCounts.Add("fetch.receive", 0)
+	errorCounts.Add("listen.truncated", 0)
 
-	laddr, err := net.ResolveUDPAddr("udp", config.Bind)
-	if err != nil {
-		log.Fatalln("[fatal] Listen: failed to resolve address", err)
+	if err := config.Validate(); err != nil {
+		log.Fatalf("[fatal] Listen: %s", err)
 	}
 
-	conn, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		log.Fatalln("[fatal] Listen: failed to listen", err)
+	// Protocols that don't use collectd's binary protocol
+	switch config.Protocol {
+	case ProtocolWriteHTTP:
+		listenHTTP(config, c)
+		return
+	case ProtocolGraphite, ProtocolGraphiteUDP, ProtocolStatsd:
+		listenLines(config, c)
+		return
 	}
 
-	types, err := collectd.TypesDBFile(config.Typesdb)
+	types, err := config.Typesdb.Load()
 	if err != nil {
 		log.Fatalln("[fatal] Listen: failed to parse types.db", err)
 	}
+	decoder, err := newDecoder(config, types)
+	if err != nil {
+		log.Fatalln("[fatal] Listen: failed to open capture file", err)
+	}
 
-	for {
-		// 1452 is collectd 5's default buffer size. See:
-		// https://collectd.org/wiki/index.php/Binary_protocol
-		buf := make([]byte, 1452)
+	if config.Protocol == ProtocolCollectdTCP {
+		listenTCP(config, decoder, c)
+		return
+	}
 
-		n, err := conn.Read(buf[:])
+	// Bind all the sockets up front, so we fail fast
+	count := config.Readers()
+	addr := config.Bind
+	conns := make([]*net.UDPConn, count)
+	inodes := make([]uint64, count)
+	for i := range conns {
+		conn, inode, err := listenUDP(addr, count > 1)
+		if err != nil {
+			log.Fatalln("[fatal] Listen: failed to listen", err)
+		}
+		// Bind subsequent sockets to the same port if one was picked for us
+		addr = conn.LocalAddr().String()
+
+		if config.ReadBuffer > 0 {
+			if err := conn.SetReadBuffer(config.ReadBuffer); err != nil {
+				log.Fatalln("[fatal] Listen: failed to set receive buffer size", err)
+			}
+			size, err := readBuffer(conn)
+			if err == nil && size < config.ReadBuffer {
+				log.Printf("[warning] Listen: receive buffer size capped at %d bytes by the kernel, check net.core.rmem_max", size)
+			}
+		}
+		conns[i], inodes[i] = conn, inode
+	}
+	watchKernelDrops(inodes)
+	log.Printf("[info] Listen: listening for collectd packets on %s with %d sockets", addr, count)
+
+	for _, conn := range conns[1:] {
+		go receive(conn, config, decoder, c)
+	}
+	receive(conns[0], config, decoder, c)
+}
+
+// receive reads collectd network packets off a socket, and queues the samples
+// for Filter.
+func receive(conn *net.UDPConn, config ListenConfig, decoder *decoder, c chan collectd.Packet) {
+	// The buffer is reused for every read, as decoding copies everything out
+	// of it. It has room for an extra byte, so a datagram that fills it must
+	// have been truncated by the kernel.
+	size := config.PacketSize()
+	buf := make([]byte, size+1)
+	for {
+		n, source, err := conn.ReadFromUDP(buf[:])
 		if err != nil {
 			log.Println("[error] Listen: Failed to receive packet", err)
 			errorCounts.Add("fetch.receive", 1)
@@ -128,10 +202,16 @@ func Listen(config ListenConfig, c chan collectd.Packet) {
 		}
 		listenCounts.Add("raw", 1)
 
-		packets, err := collectd.Packets(buf[0:n], types)
-		for _, p := range *packets {
-			listenCounts.Add("decoded", 1)
-			c <- p
+		if n > size {
+			errorCounts.Add("listen.truncated", 1)
+			continue
+		}
+
+		for _, p := range decoder.decode(buf[0:n], source.String()) {
+			accept(config, c, p)
+		}
+		for _, n := range parseNotifications(buf[0:n]) {
+			acceptNotification(config, n)
 		}
 	}
 }
@@ -155,28 +235,76 @@ func MetricName(packet collectd.Packet) string {
 	return strings.Join(parts, "/")
 }
 
+// Helper function to provide a default number of Filter workers
+func (f *FilterConfig) Concurrency() int {
+	if f.Workers == 0 {
+		return 4
+	} else {
+		return f.Workers
+	}
+}
+
+// Validate checks the blacklist is a valid regex, and there are workers
+func (f *FilterConfig) Validate() error {
+	if f.Workers < 0 {
+		return fmt.Errorf("invalid filter workers %d", f.Workers)
+	}
+	if _, err := regexp.Compile(f.Blacklist); err != nil {
+		return fmt.Errorf("invalid blacklist: %s", err)
+	}
+	return nil
+}
+
+// How long a Filter worker waits before restarting after a panic, so a
+// sample that keeps panicking doesn't spin the worker and flood the log
+const filterRestartDelay = 100 * time.Millisecond
+
 func Filter(config FilterConfig, raw chan collectd.Packet, filtered chan collectd.Packet, blacklist chan BlacklistItem) {
 	// Initialise the error counts
 	errorCounts.Add("filter.unhandled", 0)
+	dropCounts.Add("filtered", 0)
+	dropCounts.Add("blacklist", 0)
+
+	re, err := regexp.Compile(config.Blacklist)
+	if err != nil {
+		log.Fatalf("[fatal] Filter: invalid blacklist: %s", err)
+	}
+
+	// Keep filtering if a sample can't be handled, so the worker isn't lost
+	processed := newWorker("filter")
+	for {
+		filter(config, re, processed, raw, filtered, blacklist)
+		time.Sleep(filterRestartDelay)
+	}
+}
 
+// filter blacklists or accepts samples until one can't be handled
+func filter(config FilterConfig, re *regexp.Regexp, processed *expvar.Int, raw chan collectd.Packet, filtered chan collectd.Packet, blacklist chan BlacklistItem) {
 	// Track unhandled errors
 	defer func() {
 		if r := recover(); r != nil {
+			log.Printf("[error] Filter: couldn't handle sample, restarting: %v", r)
 			errorCounts.Add("filter.unhandled", 1)
 		}
 	}()
 
 	for {
 		packet := <-raw
+		processed.Add(1)
 		name := MetricName(packet)
 		full := packet.Hostname + "/" + name
 
-		re := regexp.MustCompile(config.Blacklist)
-		if re.FindStringIndex(full) == nil {
-			filtered <- packet
+		if !re.MatchString(full) && !config.Rules.Match(full) {
+			// Samples over the rate limits are counted by the limiter
+			if !config.Limiter.Allow(packet.Hostname, name) {
+				continue
+			}
+			config.Aggregator.Add(packet)
+			enqueue("filtered", config.Filtered, filtered, packet)
 			filterCounts.Add("accepted", 1)
 		} else {
-			blacklist <- BlacklistItem{Packet: packet, Time: time.Now().Unix()}
+			item := BlacklistItem{Packet: packet, Time: time.Now().Unix()}
+			enqueue("blacklist", config.Blacklisted, blacklist, item)
 			filterCounts.Add("rejected", 1)
 		}
 	}
@@ -187,10 +315,12 @@ func Blacklist(updates chan BlacklistItem, blacklisted *map[string]map[string]in
 		item := <-updates
 		packet := item.Packet
 		name := MetricName(item.Packet)
+		blacklistLock.Lock()
 		if (*blacklisted)[packet.Hostname] == nil {
 			(*blacklisted)[packet.Hostname] = make(map[string]int64)
 		}
 		(*blacklisted)[packet.Hostname][name] = item.Time
+		blacklistLock.Unlock()
 	}
 }
 
@@ -206,14 +336,39 @@ func BuildTiers(tiers *[]Tier) {
 		(*tiers)[i].Shadows = make(map[string]string)
 		// map that tracks all the UDP connections
 		(*tiers)[i].Connections = make(map[string]net.Conn)
-		// map that tracks all target -> host -> metric -> last dispatched relationships
-		(*tiers)[i].Mappings = make(map[string]map[string]map[string]int64)
+		// map that tracks all target -> host -> metric -> last dispatched relationships,
+		// which may have already been populated by Restore
+		if (*tiers)[i].Mappings == nil {
+			(*tiers)[i].Mappings = make(map[string]map[string]map[string]int64)
+		}
 		// Set the virtual replica number from magical pre-computed values
 		(*tiers)[i].SetMagicVirtualReplicaNumber(len(tier.Targets))
 
 		// Populate ratio counters per tier
 		distCounts.Set(tier.Name, new(expvar.Map).Init())
 
+		switch tier.Notifications {
+		case "", NotifyRoute, NotifyBroadcast:
+		default:
+			log.Fatalf("[fatal] BuildTiers: unknown notifications mode '%s' in tier '%s'", tier.Notifications, tier.Name)
+		}
+
+		switch tier.Downsample.Aggregate {
+		case "", AggregateAverage, AggregateLast:
+		default:
+			log.Fatalf("[fatal] BuildTiers: unknown aggregate '%s' in tier '%s'", tier.Downsample.Aggregate, tier.Name)
+		}
+
+		// Catch endpoints that have been configured for targets not in the tier
+		for target, endpoint := range tier.Endpoints {
+			if !tier.HasTarget(target) {
+				log.Fatalf("[fatal] BuildTiers: fetch endpoint configured for unknown target '%s' in tier '%s'", target, tier.Name)
+			}
+			if len(endpoint.URL) > 0 && !strings.Contains(endpoint.URL, "://") {
+				log.Fatalf("[fatal] BuildTiers: fetch endpoint URL '%s' for target '%s' has no scheme", endpoint.URL, target)
+			}
+		}
+
 		for it, t := range tier.Targets {
 			conn, err := net.Dial("udp", t)
 			if err != nil {
@@ -229,7 +384,9 @@ func BuildTiers(tiers *[]Tier) {
 				}
 			}
 			(*tiers)[i].Connections[t] = conn
-			(*tiers)[i].Mappings[t] = make(map[string]map[string]int64)
+			if (*tiers)[i].Mappings[t] == nil {
+				(*tiers)[i].Mappings[t] = make(map[string]map[string]int64)
+			}
 			// Setup a shadow mapping so we get a more even hash distribution
 			shadow_t := string(it)
 			(*tiers)[i].Shadows[shadow_t] = t
@@ -237,6 +394,33 @@ func BuildTiers(tiers *[]Tier) {
 			metricCounts.Set(t, &expvar.Int{})
 			hostCounts.Set(t, &expvar.Int{})
 		}
+
+		// Drop routes restored from a snapshot for hosts that now hash to a
+		// different target, e.g. because a target was added to the tier, and
+		// count the rest
+		routesLock.Lock()
+		moved := 0
+		for target, hosts := range (*tiers)[i].Mappings {
+			for host, _ := range hosts {
+				if t, err := (*tiers)[i].Lookup(host); err != nil || t != target {
+					delete(hosts, host)
+					moved += 1
+				}
+			}
+			countRoutes(target, hosts)
+		}
+		routesLock.Unlock()
+		if moved > 0 {
+			log.Printf("[info] BuildTiers: dropped restored routes for %d hosts that no longer hash to the same target in tier '%s'", moved, tier.Name)
+		}
+	}
+
+	// Setup on-disk spools for targets that can't be written to, batches
+	// for samples on their way to targets, and downsampling
+	for i, _ := range *tiers {
+		buildSpools(&(*tiers)[i])
+		buildBatches(&(*tiers)[i])
+		buildDownsampler(&(*tiers)[i])
 	}
 
 	// Log how the hashes are set up
@@ -256,171 +440,233 @@ func BuildTiers(tiers *[]Tier) {
 	}
 }
 
+// Send dispatches samples to targets in every tier.
 func Send(tiers *[]Tier, filtered chan collectd.Packet) {
+	SendWorkers(SendConfig{}, tiers, filtered, nil)
+}
+
+// SendWorkers dispatches samples and notifications to targets in every tier,
+// with as many workers as are configured.
+func SendWorkers(config SendConfig, tiers *[]Tier, filtered chan collectd.Packet, notifications chan Notification) {
 	// Initialise the error counts
 	errorCounts.Add("send.write", 0)
 	errorCounts.Add("send.disconnected", 0)
+	errorCounts.Add("send.oversize", 0)
+	errorCounts.Add("send.encode", 0)
+	cardinalityCounts.Add("exceeded", 0)
+	cardinalityCounts.Add("rejected", 0)
+	errorCounts.Add("send.notification", 0)
 
 	BuildTiers(tiers)
 
-	for {
-		packet := <-filtered
-		for _, tier := range *tiers {
-			// FIXME(lindsay): fire off a goroutine for dispatch to each tier
+	// Periodically flush batches, so samples aren't held back indefinitely
+	// when a target only receives a trickle. Only one worker needs to.
+	var flush <-chan time.Time
+	if interval := flushInterval(tiers); interval > 0 {
+		flush = time.NewTicker(interval).C
+	}
+	// Periodically emit downsampled samples
+	var emit <-chan time.Time
+	if tick := downsampleTick(tiers); tick > 0 {
+		emit = time.NewTicker(tick).C
+	}
 
-			// Get the target we should forward the packet to
-			target, err := tier.Lookup(packet.Hostname)
-			if err != nil {
-				log.Fatalf("[fatal] Send: couldn't lookup target: %s\n", err)
-			}
+	for i := 1; i < config.Concurrency(); i++ {
+		go send(tiers, filtered, notifications, nil, nil)
+	}
+	send(tiers, filtered, notifications, flush, emit)
+}
 
-			// Update metadata
-			name := MetricName(packet)
-			if tier.Mappings[target][packet.Hostname] == nil {
-				tier.Mappings[target][packet.Hostname] = make(map[string]int64)
+// send is a Send worker
+func send(tiers *[]Tier, filtered chan collectd.Packet, notifications chan Notification, flush <-chan time.Time, emit <-chan time.Time) {
+	processed := newWorker("send")
+	for {
+		var packet collectd.Packet
+		select {
+		case packet = <-filtered:
+		case n := <-notifications:
+			notify(tiers, n)
+			continue
+		case <-flush:
+			for i, _ := range *tiers {
+				(*tiers)[i].flushAll()
 			}
-			tier.Mappings[target][packet.Hostname][name] = time.Now().Unix()
-
-			// Dispatch the metric
-			payload := Encode(packet)
-			conn := tier.Connections[target]
-			if conn != nil {
-				_, err = tier.Connections[target].Write(payload)
-				if err != nil {
-					// Increment counter, but don't log because that will fill
-					// up the disk when a storage target goes away during a
-					// network partition.
-					errorCounts.Add("send.write", 1)
-					continue
-				}
-				// Update counters
-				hostCounts.Get(target).(*expvar.Int).Set(int64(len(tier.Mappings[target])))
-				mc := 0
-				for _, v := range tier.Mappings[target] {
-					mc += len(v)
-				}
-				metricCounts.Get(target).(*expvar.Int).Set(int64(mc))
-				sendCounts.Add(target, 1)
-				sendCounts.Add("total", 1)
-			} else {
-				errorCounts.Add("send.disconnected", 1)
+			continue
+		case now := <-emit:
+			for i, _ := range *tiers {
+				(*tiers)[i].emitDownsampled(now)
+			}
+			continue
+		}
+
+		processed.Add(1)
+		payload, err := Encode(packet)
+		if err != nil {
+			// Don't log, as a misbehaving client could fill up the disk
+			errorCounts.Add("send.encode", 1)
+			continue
+		}
+		for i, _ := range *tiers {
+			tier := &(*tiers)[i]
+			// FIXME(lindsay): fire off a goroutine for dispatch to each tier
+			if tier.downsampler != nil {
+				tier.downsample(packet)
+				continue
 			}
+			tier.route(packet, payload)
 		}
 	}
 }
 
-// Encode a Packet into the collectd wire protocol format.
-func Encode(packet collectd.Packet) []byte {
-	// String parts have a length of 5, because there is a terminating null byte
-	// Numeric parts have a length of 4, because there is no terminating null byte
+// route dispatches an encoded sample to its target in a tier
+func (t *Tier) route(packet collectd.Packet, payload []byte) {
+	// Get the target we should forward the packet to
+	target, err := t.Lookup(packet.Hostname)
+	if err != nil {
+		log.Fatalf("[fatal] Send: couldn't lookup target: %s\n", err)
+	}
 
-	buf := make([]byte, 0)
-	null := []byte("\x00")
+	// Update metadata. Every Send worker takes this lock for every sample, so
+	// only do what must be done under it.
+	name := MetricName(packet)
+	now := time.Now().Unix()
+	routesLock.Lock()
+	metrics := t.Mappings[target][packet.Hostname]
+	if metrics == nil {
+		metrics = make(map[string]int64)
+		t.Mappings[target][packet.Hostname] = metrics
+		hostCounts.Get(target).(*expvar.Int).Add(1)
+	}
+	if !t.admit(target, packet.Hostname, name) {
+		routesLock.Unlock()
+		return
+	}
+	if _, ok := metrics[name]; !ok {
+		metricCounts.Get(target).(*expvar.Int).Add(1)
+	}
+	metrics[name] = now
+	routesLock.Unlock()
 
-	// Hostname - String part
-	hostBytes := []byte(packet.Hostname)
-	buf = append(buf, []byte{0, collectd.ParseHost}...)
-	buf = append(buf, []byte{0, byte(len(hostBytes) + 5)}...)
-	buf = append(buf, hostBytes...)
-	buf = append(buf, null...) // null bytes for string parts
+	// Dispatch the metric
+	t.queue(target, payload)
+}
 
-	// Time - Number part
-	if packet.Time > 0 {
-		timeBytes := new(bytes.Buffer)
-		binary.Write(timeBytes, binary.BigEndian, packet.Time)
-		buf = append(buf, []byte{0, collectd.ParseTime}...)
-		buf = append(buf, []byte{0, byte(len(timeBytes.Bytes()) + 4)}...)
-		buf = append(buf, timeBytes.Bytes()...)
+// countRoutes sets the hash counters for a target from its Mappings. Must be
+// called with routesLock held.
+func countRoutes(target string, hosts map[string]map[string]int64) {
+	if v, ok := hostCounts.Get(target).(*expvar.Int); ok {
+		v.Set(int64(len(hosts)))
 	}
-
-	// TimeHR - Number part
-	if packet.TimeHR > 0 {
-		timeHRBytes := new(bytes.Buffer)
-		binary.Write(timeHRBytes, binary.BigEndian, packet.TimeHR)
-		buf = append(buf, []byte{0, collectd.ParseTimeHR}...)
-		buf = append(buf, []byte{0, byte(len(timeHRBytes.Bytes()) + 4)}...)
-		buf = append(buf, timeHRBytes.Bytes()...)
+	if v, ok := metricCounts.Get(target).(*expvar.Int); ok {
+		mc := 0
+		for _, metrics := range hosts {
+			mc += len(metrics)
+		}
+		v.Set(int64(mc))
 	}
+}
 
-	// Interval - Number part
-	if packet.Interval > 0 {
-		intervalBytes := new(bytes.Buffer)
-		binary.Write(intervalBytes, binary.BigEndian, packet.Interval)
-		buf = append(buf, []byte{0, collectd.ParseInterval}...)
-		buf = append(buf, []byte{0, byte(len(intervalBytes.Bytes()) + 4)}...)
-		buf = append(buf, intervalBytes.Bytes()...)
+// The most values that fit in a values part: the part header and value count
+// take 6 bytes, and each value takes 9 bytes (1 for its type, 8 for itself).
+const maxValues = (65535 - 6) / 9
+
+// validateString checks a string can be encoded as a string part. Parts have
+// 16-bit lengths, and strings are null terminated.
+func validateString(field string, s string) error {
+	// Leave room for the part header and terminating null byte
+	if len(s) > 65535-5 {
+		return fmt.Errorf("%s is %d bytes, more than can be encoded", field, len(s))
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return fmt.Errorf("%s contains a null byte", field)
 	}
+	return nil
+}
 
-	if packet.IntervalHR > 0 {
-		intervalHRBytes := new(bytes.Buffer)
-		binary.Write(intervalHRBytes, binary.BigEndian, packet.IntervalHR)
-		buf = append(buf, []byte{0, collectd.ParseIntervalHR}...)
-		buf = append(buf, []byte{0, byte(len(intervalHRBytes.Bytes()) + 4)}...)
-		buf = append(buf, intervalHRBytes.Bytes()...)
+// encodeValue converts a value to the 8 bytes it is sent as. Gauges are
+// little endian doubles, counters and absolutes are big endian unsigned
+// integers, and derives are big endian signed integers.
+func encodeValue(v collectd.Value) ([]byte, error) {
+	b := make([]byte, 8)
+	switch v.Type {
+	case collectd.TypeGauge:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(v.Value))
+	case collectd.TypeCounter, collectd.TypeAbsolute:
+		// 2^64 can't be represented as a uint64
+		if math.IsNaN(v.Value) || v.Value < 0 || v.Value >= math.Exp2(64) {
+			return nil, fmt.Errorf("%s value %v is out of range", collectd.ValueTypeValues[v.Type], v.Value)
+		}
+		binary.BigEndian.PutUint64(b, uint64(v.Value))
+	case collectd.TypeDerive:
+		if math.IsNaN(v.Value) || v.Value < -math.Exp2(63) || v.Value >= math.Exp2(63) {
+			return nil, fmt.Errorf("derive value %v is out of range", v.Value)
+		}
+		binary.BigEndian.PutUint64(b, uint64(int64(v.Value)))
+	default:
+		return nil, fmt.Errorf("unknown value type %d", v.Type)
 	}
+	return b, nil
+}
 
-	// Plugin - String part
-	pluginBytes := []byte(packet.Plugin)
-	buf = append(buf, []byte{0, collectd.ParsePlugin}...)
-	buf = append(buf, []byte{0, byte(len(pluginBytes) + 5)}...)
-	buf = append(buf, pluginBytes...)
-	buf = append(buf, null...) // null bytes for string parts
+// Encode a Packet into the collectd wire protocol format. An error is returned
+// if any of the packet's fields can't be represented on the wire.
+func Encode(packet collectd.Packet) ([]byte, error) {
+	fields := map[string]string{
+		"host":            packet.Hostname,
+		"plugin":          packet.Plugin,
+		"plugin_instance": packet.PluginInstance,
+		"type":            packet.Type,
+		"type_instance":   packet.TypeInstance,
+	}
+	for field, s := range fields {
+		if err := validateString(field, s); err != nil {
+			return nil, err
+		}
+	}
+	if len(packet.Values) > maxValues {
+		return nil, fmt.Errorf("%d values, more than the %d that can be encoded", len(packet.Values), maxValues)
+	}
 
-	// PluginInstance - String part
+	buf := appendString(nil, collectd.ParseHost, packet.Hostname)
+	if packet.Time > 0 {
+		buf = appendNumber(buf, collectd.ParseTime, packet.Time)
+	}
+	if packet.TimeHR > 0 {
+		buf = appendNumber(buf, collectd.ParseTimeHR, packet.TimeHR)
+	}
+	if packet.Interval > 0 {
+		buf = appendNumber(buf, collectd.ParseInterval, packet.Interval)
+	}
+	if packet.IntervalHR > 0 {
+		buf = appendNumber(buf, collectd.ParseIntervalHR, packet.IntervalHR)
+	}
+	buf = appendString(buf, collectd.ParsePlugin, packet.Plugin)
 	if len(packet.PluginInstance) > 0 {
-		pluginInstanceBytes := []byte(packet.PluginInstance)
-		buf = append(buf, []byte{0, collectd.ParsePluginInstance}...)
-		buf = append(buf, []byte{0, byte(len(pluginInstanceBytes) + 5)}...)
-		buf = append(buf, pluginInstanceBytes...)
-		buf = append(buf, null...) // null bytes for string parts
+		buf = appendString(buf, collectd.ParsePluginInstance, packet.PluginInstance)
 	}
-
-	// Type - String part
-	typeBytes := []byte(packet.Type)
-	buf = append(buf, []byte{0, collectd.ParseType}...)
-	buf = append(buf, []byte{0, byte(len(typeBytes) + 5)}...)
-	buf = append(buf, typeBytes...)
-	buf = append(buf, null...) // null bytes for string parts
-
-	// TypeInstance - String part
+	buf = appendString(buf, collectd.ParseType, packet.Type)
 	if len(packet.TypeInstance) > 0 {
-		typeInstanceBytes := []byte(packet.TypeInstance)
-		buf = append(buf, []byte{0, collectd.ParseTypeInstance}...)
-		buf = append(buf, []byte{0, byte(len(typeInstanceBytes) + 5)}...)
-		buf = append(buf, typeInstanceBytes...)
-		buf = append(buf, null...) // null bytes for string parts
+		buf = appendString(buf, collectd.ParseTypeInstance, packet.TypeInstance)
 	}
 
-	// Values - Values part
-	valuesBuf := make([]byte, 0)
-
-	// Write out the types
+	// Values part: header, number of values, every value's type, then every
+	// value.
+	length := 6 + 9*len(packet.Values)
+	part := make([]byte, 6, length)
+	binary.BigEndian.PutUint16(part[0:2], collectd.ParseValues)
+	binary.BigEndian.PutUint16(part[2:4], uint16(length))
+	binary.BigEndian.PutUint16(part[4:6], uint16(len(packet.Values)))
 	for _, v := range packet.Values {
-		valueTypeBytes := new(bytes.Buffer)
-		binary.Write(valueTypeBytes, binary.BigEndian, v.Type)
-		valuesBuf = append(valuesBuf, valueTypeBytes.Bytes()...)
+		part = append(part, v.Type)
 	}
-
-	// Then write out the values
 	for _, v := range packet.Values {
-		if v.Type == collectd.TypeGauge {
-			gaugeBytes := new(bytes.Buffer)
-			binary.Write(gaugeBytes, binary.LittleEndian, v.Value)
-			valuesBuf = append(valuesBuf, gaugeBytes.Bytes()...)
-		} else {
-			valueBytes := new(bytes.Buffer)
-			binary.Write(valueBytes, binary.BigEndian, v.Value)
-			valuesBuf = append(valuesBuf, valueBytes.Bytes()...)
+		b, err := encodeValue(v)
+		if err != nil {
+			return nil, err
 		}
+		part = append(part, b...)
 	}
-
-	// type(2) + length(2) + number of values(2) == 6
-	buf = append(buf, []byte{0, collectd.ParseValues}...)     // type
-	buf = append(buf, []byte{0, byte(len(valuesBuf) + 6)}...) // length
-	buf = append(buf, []byte{0, byte(len(packet.Values))}...) // number of values
-	buf = append(buf, valuesBuf...)                           // values themselves
-
-	return buf
+	return append(buf, part...), nil
 }
 
 func TierLookup(params martini.Params, req *http.Request, tiers *[]Tier) []byte {
@@ -501,14 +747,56 @@ func Api(config ApiConfig, tiers *[]Tier, blacklisted *map[string]map[string]int
 	// Dump out the list of targets Coco is hashing metrics to
 	m.Group("/tiers", func(r martini.Router) {
 		r.Get("", func() []byte {
-			data, _ := json.Marshal(*tiers)
+			// Serialise a copy, so Send isn't held up while it's encoded
+			routesLock.RLock()
+			copied := make([]Tier, len(*tiers))
+			for i, tier := range *tiers {
+				tier.Mappings = copyRoutes(tier.Mappings)
+				copied[i] = tier
+			}
+			routesLock.RUnlock()
+			data, _ := json.Marshal(copied)
 			return data
 		})
 	})
+	// Discover what hosts and metrics Coco has routed
+	m.Get("/hosts", func(req *http.Request) (int, []byte) {
+		return Hosts(req, tiers)
+	})
+	m.Get("/hosts/:host/metrics", func(params martini.Params, req *http.Request) (int, []byte) {
+		return HostMetrics(params["host"], req, tiers)
+	})
+	m.Get("/search", func(req *http.Request) (int, []byte) {
+		return Search(req, tiers)
+	})
 	m.Get("/blacklisted", func(params martini.Params, req *http.Request) []byte {
+		blacklistLock.RLock()
+		defer blacklistLock.RUnlock()
 		data, _ := json.Marshal(*blacklisted)
 		return data
 	})
+	// Manage blacklist rules at runtime
+	m.Get("/filters", func() (int, []byte) {
+		return ListFilters(config.Rules)
+	})
+	m.Post("/filters", func(req *http.Request) (int, []byte) {
+		return AddFilter(req, config.Rules)
+	})
+	m.Delete("/filters/:id", func(params martini.Params) (int, []byte) {
+		return RemoveFilter(params["id"], config.Rules)
+	})
+	// Hosts that have had samples dropped by rate limits
+	m.Get("/limited", func() []byte {
+		return config.Limiter.Limited()
+	})
+	// Rank the hosts and plugins with the most metrics
+	m.Get("/cardinality", func(req *http.Request) (int, []byte) {
+		return Cardinality(req, tiers)
+	})
+	// Find hosts and metrics that have stopped reporting
+	m.Get("/stale", func(req *http.Request) (int, []byte) {
+		return Stale(req, tiers)
+	})
 	// Implement expvars.expvarHandler in Martini.
 	m.Get("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
 		ExpvarHandler(w, r)
@@ -519,37 +807,192 @@ func Api(config ApiConfig, tiers *[]Tier, blacklisted *map[string]map[string]int
 }
 
 type Config struct {
-	Listen  ListenConfig
-	Filter  FilterConfig
-	Tiers   map[string]TierConfig
-	Api     ApiConfig
-	Fetch   FetchConfig
-	Measure MeasureConfig
+	Listen      Listeners
+	Filter      FilterConfig
+	Send        SendConfig
+	Tiers       map[string]TierConfig
+	Api         ApiConfig
+	Fetch       FetchConfig
+	Measure     MeasureConfig
+	Expire      ExpireConfig
+	Persist     PersistConfig
+	Spill       SpillConfig
+	Queues      QueuesConfig
+	Limits      LimitsConfig
+	Cardinality CardinalityConfig
+	Aggregate   []AggregateConfig
 }
 
 type ListenConfig struct {
-	Bind    string
-	Typesdb string
+	Bind string
+	// Typesdb is the types.db files used to decode collectd packets
+	Typesdb TypesDB
+	// Protocol is one of "collectd" (collectd's binary protocol over UDP),
+	// "collectd-tcp" (the binary protocol over TCP), "write_http" (JSON
+	// POSTed by collectd's write_http plugin), "graphite" (Graphite's
+	// plaintext protocol over TCP), "graphite-udp", or "statsd" (over UDP).
+	Protocol string
+	// Templates map Graphite paths and StatsD names to identifier fields
+	Templates []string
+	// Notifications is where collectd notifications are queued for Send,
+	// and NotificationsQueue is how, set from [queues.notifications]
+	Notifications      chan Notification `toml:"-"`
+	NotificationsQueue QueueConfig       `toml:"-"`
+	// Tags are default values for identifier fields (host, plugin,
+	// plugin_instance, type, type_instance) not set on received samples.
+	Tags map[string]string
+	// Sockets is the number of sockets to bind with SO_REUSEPORT, each read
+	// by its own goroutine.
+	Sockets int
+	// MaxPacketSize is the largest datagram that will be accepted. Larger
+	// datagrams are truncated by the kernel, and dropped.
+	MaxPacketSize int `toml:"max_packet_size"`
+	// ReadBuffer is the receive buffer size to request for each socket.
+	ReadBuffer int `toml:"read_buffer"`
+	// Capture is a file to append packets that couldn't be decoded to, up
+	// to CaptureMaxBytes.
+	Capture         string
+	CaptureMaxBytes int64 `toml:"capture_max_bytes"`
+	// Queue is how samples are queued for Filter, set from [queues.raw]
+	Queue QueueConfig `toml:"-"`
+}
+
+// Helper function to provide a default maximum packet size
+func (l *ListenConfig) PacketSize() int {
+	if l.MaxPacketSize == 0 {
+		// 1452 is collectd 5's default buffer size. See:
+		// https://collectd.org/wiki/index.php/Binary_protocol
+		return 1452
+	} else {
+		return l.MaxPacketSize
+	}
+}
+
+// Validate checks the protocol, tags, and maximum packet size are ones we know
+// how to handle
+func (l *ListenConfig) Validate() error {
+	switch l.Protocol {
+	case "", ProtocolCollectd, ProtocolCollectdTCP, ProtocolWriteHTTP:
+	case ProtocolGraphite, ProtocolGraphiteUDP, ProtocolStatsd:
+		if _, err := parseTemplates(l.Templates); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown protocol '%s'", l.Protocol)
+	}
+	for k, _ := range l.Tags {
+		if _, ok := tagFields[k]; !ok {
+			return fmt.Errorf("unknown tag '%s'", k)
+		}
+	}
+	if l.PacketSize() < 1 || l.PacketSize() > 65535 {
+		return fmt.Errorf("max_packet_size must be between 1 and 65535, got %d", l.PacketSize())
+	}
+	return nil
+}
+
+// Helper function to provide a default capture file size limit
+func (l *ListenConfig) CaptureLimit() int64 {
+	if l.CaptureMaxBytes == 0 {
+		return 64 * 1024 * 1024
+	} else {
+		return l.CaptureMaxBytes
+	}
+}
+
+// Helper function to provide a default number of sockets
+func (l *ListenConfig) Readers() int {
+	if l.Sockets <= 0 {
+		return 1
+	} else {
+		return l.Sockets
+	}
 }
 
 type FilterConfig struct {
 	Blacklist string
+	// Workers is how many Filter goroutines to run
+	Workers int
+	// Filtered and Blacklisted are how samples are queued for Send and
+	// Blacklist, set from [queues.filtered] and [queues.blacklist]
+	Filtered    QueueConfig `toml:"-"`
+	Blacklisted QueueConfig `toml:"-"`
+	// Limiter applies the rate limits from [limits]
+	Limiter *Limiter `toml:"-"`
+	// RulesPath is where rules added through the API are saved, if set
+	RulesPath string `toml:"rules_path"`
+	// Rules are the blacklist rules added through the API
+	Rules *FilterRules `toml:"-"`
+	// Aggregator rolls up accepted samples by the rules in [[aggregate]]
+	Aggregator *Aggregator `toml:"-"`
 }
 
 type TierConfig struct {
 	Targets []string
+	// Optional per-target overrides for how Noodle fetches from a target
+	Fetch map[string]EndpointConfig
+	// Notifications is either "route" or "broadcast"
+	Notifications string
+	// Optional batching of samples into datagrams of up to MaxPacketSize
+	MaxPacketSize int      `toml:"max_packet_size"`
+	FlushInterval Duration `toml:"flush_interval"`
+	// Optional downsampling to one sample per host/metric per MinInterval,
+	// with gauges aggregated by Aggregate
+	MinInterval Duration `toml:"min_interval"`
+	Aggregate   string
+}
+
+// EndpointConfig describes how to reach the Visage serving a target's metrics.
+// If URL is set, it is used as the base for all requests and the other
+// options are ignored.
+type EndpointConfig struct {
+	URL        string `toml:"url" json:"url,omitempty"`
+	Scheme     string `toml:"scheme" json:"scheme,omitempty"`
+	Host       string `toml:"host" json:"host,omitempty"`
+	Port       string `toml:"port" json:"port,omitempty"`
+	PathPrefix string `toml:"path_prefix" json:"path_prefix,omitempty"`
+}
+
+// SendConfig describes how samples are dispatched to targets
+type SendConfig struct {
+	// Workers is how many Send goroutines to run
+	Workers int
+}
+
+// Validate checks there are workers
+func (s *SendConfig) Validate() error {
+	if s.Workers < 0 {
+		return fmt.Errorf("invalid send workers %d", s.Workers)
+	}
+	return nil
+}
+
+// Helper function to provide a default number of Send workers
+func (s *SendConfig) Concurrency() int {
+	if s.Workers == 0 {
+		return 1
+	} else {
+		return s.Workers
+	}
 }
 
 type ApiConfig struct {
 	Bind string
+	// Limiter is listed at /limited
+	Limiter *Limiter `toml:"-"`
+	// Rules are managed at /filters
+	Rules *FilterRules `toml:"-"`
 }
 
 type FetchConfig struct {
 	Bind         string
 	ProxyTimeout Duration `toml:"proxy_timeout"`
-	// FIXME(lindsay): RemotePort is a bit of a code smell.
-	// Ideally every target could define its own port for collectd + Visage.
+	// RemotePort is the default port used for targets that don't define their
+	// own fetch endpoint under their tier.
 	RemotePort string `toml:"remote_port"`
+	// Mode is either "rewrite" (inject metadata into the JSON body) or "stream"
+	// (pipe the body through, and only expose metadata in headers).
+	Mode string `toml:"mode"`
 }
 
 // Helper function to provide a default timeout value
@@ -561,6 +1004,21 @@ func (f *FetchConfig) Timeout() time.Duration {
 	}
 }
 
+// Helper function to determine if responses should be streamed to clients
+func (f *FetchConfig) Streaming() bool {
+	return f.Mode == "stream"
+}
+
+// ValidateMode checks the configured fetch mode is one we know how to handle
+func (f *FetchConfig) ValidateMode() error {
+	switch f.Mode {
+	case "", "rewrite", "stream":
+		return nil
+	default:
+		return fmt.Errorf("unknown fetch mode '%s'", f.Mode)
+	}
+}
+
 type MeasureConfig struct {
 	TickInterval Duration `toml:"interval"`
 }
@@ -574,6 +1032,68 @@ func (m *MeasureConfig) Interval() time.Duration {
 	}
 }
 
+type ExpireConfig struct {
+	TTL          Duration `toml:"ttl"`
+	TickInterval Duration `toml:"interval"`
+}
+
+// Helper function to provide a default interval value
+func (e *ExpireConfig) Interval() time.Duration {
+	if e.TickInterval.Duration == 0 {
+		return time.Minute
+	} else {
+		return e.TickInterval.Duration
+	}
+}
+
+type PersistConfig struct {
+	Path         string
+	TickInterval Duration `toml:"interval"`
+}
+
+// Helper function to provide a default interval value
+func (p *PersistConfig) Interval() time.Duration {
+	if p.TickInterval.Duration == 0 {
+		return time.Minute
+	} else {
+		return p.TickInterval.Duration
+	}
+}
+
+type SpillConfig struct {
+	Path          string
+	MaxBytes      int64    `toml:"max_bytes"`
+	ReplayRate    int      `toml:"replay_rate"`
+	RetryInterval Duration `toml:"retry_interval"`
+}
+
+// Helper function to provide a default maximum spool size
+func (s *SpillConfig) Limit() int64 {
+	if s.MaxBytes == 0 {
+		return 256 * 1024 * 1024
+	} else {
+		return s.MaxBytes
+	}
+}
+
+// Helper function to provide a default replay rate, in packets per second
+func (s *SpillConfig) Rate() int {
+	if s.ReplayRate == 0 {
+		return 1000
+	} else {
+		return s.ReplayRate
+	}
+}
+
+// Helper function to provide a default retry interval
+func (s *SpillConfig) Retry() time.Duration {
+	if s.RetryInterval.Duration == 0 {
+		return 10 * time.Second
+	} else {
+		return s.RetryInterval.Duration
+	}
+}
+
 type Duration struct {
 	time.Duration
 }
@@ -593,6 +1113,54 @@ type Tier struct {
 	Mappings        map[string]map[string]map[string]int64 `json:"routes"`
 	Connections     map[string]net.Conn                    `json:"connections,nil"`
 	VirtualReplicas int                                    `json:"virtual_replicas"`
+	Endpoints       map[string]EndpointConfig              `json:"endpoints,omitempty"`
+	Spill           SpillConfig                            `json:"-"`
+	Spools          map[string]*Spool                      `json:"-"`
+	Batch           BatchConfig                            `json:"-"`
+	Notifications   string                                 `json:"notifications,omitempty"`
+	Cardinality     CardinalityConfig                      `json:"-"`
+	Downsample      DownsampleConfig                       `json:"-"`
+	batches         map[string]*batch
+	downsampler     *downsampler
+	// hosts that have been logged as over the cardinality limit
+	overLimit map[string]bool
+}
+
+// FetchURL builds the URL to fetch path from for a target in the tier, using
+// the target's endpoint if it has one, and falling back to the target's
+// address on remotePort if it doesn't.
+func (t *Tier) FetchURL(target string, remotePort string, path string) (host string, url string) {
+	endpoint := t.Endpoints[target]
+	if len(endpoint.URL) > 0 {
+		base := strings.TrimRight(endpoint.URL, "/")
+		host = base
+		if i := strings.Index(host, "://"); i >= 0 {
+			host = host[i+3:]
+		}
+		host = strings.SplitN(host, "/", 2)[0]
+		return host, base + path
+	}
+
+	scheme := "http"
+	if len(endpoint.Scheme) > 0 {
+		scheme = endpoint.Scheme
+	}
+	host = strings.Split(target, ":")[0]
+	if len(endpoint.Host) > 0 {
+		host = endpoint.Host
+	}
+	// remote_port is Visage's plain HTTP port, so a target with its own
+	// scheme uses the scheme's default port unless it sets one
+	if len(endpoint.Port) > 0 {
+		host = host + ":" + endpoint.Port
+	} else if len(remotePort) > 0 && len(endpoint.Scheme) == 0 {
+		host = host + ":" + remotePort
+	}
+	prefix := strings.Trim(endpoint.PathPrefix, "/")
+	if len(prefix) > 0 {
+		prefix = "/" + prefix
+	}
+	return host, scheme + "://" + host + prefix + path
 }
 
 // Lookup maps a name to a target in a tier's hash
@@ -606,6 +1174,16 @@ func (t *Tier) Lookup(name string) (string, error) {
 	return target, nil
 }
 
+// HasTarget determines if a target is part of the tier
+func (t *Tier) HasTarget(target string) bool {
+	for _, tt := range t.Targets {
+		if tt == target {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 SetMagicVirtualReplicaNumber sets the number of virtual replicas on the hash.
 
@@ -633,6 +1211,14 @@ func (t *Tier) SetMagicVirtualReplicaNumber(i int) {
 	t.Hash.NumberOfReplicas = number
 }
 
+// routesLock guards the Mappings of all tiers, which are updated by Send,
+// expired by Expire, and read by Measure and the API.
+var routesLock sync.RWMutex
+
+// blacklistLock guards the blacklisted metrics, which are updated by
+// Blacklist, expired by Expire, and read by the API.
+var blacklistLock sync.RWMutex
+
 type BlacklistItem struct {
 	Packet collectd.Packet
 	Time   int64
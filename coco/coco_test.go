@@ -1,13 +1,21 @@
 package coco
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"expvar"
+	"github.com/BurntSushi/toml"
 	"github.com/bulletproofnetworks/coco/coco"
 	collectd "github.com/kimor79/gollectd"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -92,6 +100,323 @@ func TestFilterBlacklistsSamples(t *testing.T) {
 	}
 }
 
+// Test that samples are rate limited per host and per metric
+func TestRateLimits(t *testing.T) {
+	// Test rates can be written as integers or fractions
+	var limits coco.LimitsConfig
+	if _, err := toml.Decode("host_rate = 1000\nmetric_rate = 0.1", &limits); err != nil {
+		t.Fatalf("Couldn't decode limits: %s", err)
+	}
+	if limits.HostRate != 1000 || limits.MetricRate != 0.1 || limits.MetricBurstSize() != 1 {
+		t.Errorf("Expected rates of 1000 and 0.1 with a burst of 1, got %+v", limits)
+	}
+
+	limiter := coco.NewLimiter(coco.LimitsConfig{
+		HostRate:    0.001,
+		HostBurst:   5,
+		MetricRate:  0.001,
+		MetricBurst: 3,
+	})
+	apiConfig := coco.ApiConfig{
+		Bind:    "127.0.0.1:26819",
+		Limiter: limiter,
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	config := coco.FilterConfig{
+		Blacklist: "/(vmem|irq|entropy|users)/",
+		Limiter:   limiter,
+	}
+	raw := make(chan collectd.Packet)
+	filtered := make(chan collectd.Packet, 100)
+	blacklist := make(chan coco.BlacklistItem, 100)
+	go coco.Filter(config, raw, filtered, blacklist)
+
+	// Test the host/metric limit: only the burst gets through
+	for i := 0; i < 10; i++ {
+		raw <- collectd.Packet{Hostname: "noisy", Plugin: "load", Type: "load"}
+	}
+	// Test the host limit: the burst gets through across metrics
+	for i := 0; i < 10; i++ {
+		raw <- collectd.Packet{Hostname: "chatty", Plugin: "cpu", PluginInstance: strconv.Itoa(i), Type: "cpu"}
+	}
+	// Test hosts within the limits are unaffected
+	raw <- collectd.Packet{Hostname: "quiet", Plugin: "load", Type: "load"}
+	time.Sleep(10 * time.Millisecond)
+
+	counts := map[string]int{}
+	for len(filtered) > 0 {
+		counts[(<-filtered).Hostname] += 1
+	}
+	expected := map[string]int{"noisy": 3, "chatty": 5, "quiet": 1}
+	for host, count := range expected {
+		if counts[host] != count {
+			t.Errorf("Expected %d samples from %s, got %d", count, host, counts[host])
+		}
+	}
+
+	// Test limited hosts are listed
+	var limited map[string]coco.LimitedHost
+	fetchJSON(t, "http://"+apiConfig.Bind+"/limited", &limited)
+	if limited["noisy"].Metrics["load/load"] != 7 {
+		t.Errorf("Expected noisy's load metric to be listed as limited, got %+v", limited["noisy"])
+	}
+	if limited["chatty"].Host != 5 {
+		t.Errorf("Expected chatty to be listed as limited, got %+v", limited["chatty"])
+	}
+	if _, ok := limited["quiet"]; ok {
+		t.Errorf("Expected quiet not to be listed as limited")
+	}
+
+	// Test drops are counted
+	vars := fetchExpvar(t, apiConfig.Bind)
+	counters := vars["coco"].(map[string]interface{})["limited"].(map[string]interface{})
+	if counters["host"] != float64(5) || counters["metric"] != float64(7) || counters["hosts"] != float64(2) {
+		t.Errorf("Expected drops to be counted, got %+v", counters)
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	// Setup sender
+	tiers := []coco.Tier{
+		coco.Tier{
+			Name:        "a",
+			Targets:     []string{"127.0.0.1:25860"},
+			Cardinality: coco.CardinalityConfig{MaxMetricsPerHost: 3, Reject: true},
+		},
+	}
+	filtered := make(chan collectd.Packet)
+	go coco.Send(&tiers, filtered)
+
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26820",
+	}
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	// Test new metrics beyond the limit are rejected, but existing ones aren't
+	for i := 0; i < 5; i++ {
+		filtered <- collectd.Packet{Hostname: "exploding", Plugin: "docker", PluginInstance: strconv.Itoa(i), Type: "cpu"}
+	}
+	filtered <- collectd.Packet{Hostname: "exploding", Plugin: "docker", PluginInstance: "0", Type: "cpu"}
+	filtered <- collectd.Packet{Hostname: "calm", Plugin: "load", Type: "load"}
+	filtered <- collectd.Packet{Hostname: "calm", Plugin: "docker", PluginInstance: "0", Type: "cpu"}
+	time.Sleep(10 * time.Millisecond)
+
+	// Test hosts and plugins are ranked
+	var result coco.CardinalityJSON
+	fetchJSON(t, "http://"+apiConfig.Bind+"/cardinality", &result)
+	if result.MaxMetricsPerHost != 3 {
+		t.Errorf("Expected limit of 3, got %d", result.MaxMetricsPerHost)
+	}
+	hosts := []coco.HostCardinality{
+		coco.HostCardinality{Host: "exploding", Metrics: 3, AtLimit: true},
+		coco.HostCardinality{Host: "calm", Metrics: 2},
+	}
+	if len(result.Hosts) != len(hosts) || result.Hosts[0] != hosts[0] || result.Hosts[1] != hosts[1] {
+		t.Errorf("Expected hosts %+v, got %+v", hosts, result.Hosts)
+	}
+	plugins := []coco.PluginCardinality{
+		coco.PluginCardinality{Plugin: "docker", Metrics: 4, Hosts: 2},
+		coco.PluginCardinality{Plugin: "load", Metrics: 1, Hosts: 1},
+	}
+	if len(result.Plugins) != len(plugins) || result.Plugins[0] != plugins[0] || result.Plugins[1] != plugins[1] {
+		t.Errorf("Expected plugins %+v, got %+v", plugins, result.Plugins)
+	}
+
+	// Test the number of results can be limited
+	fetchJSON(t, "http://"+apiConfig.Bind+"/cardinality?top=1", &result)
+	if len(result.Hosts) != 1 || len(result.Plugins) != 1 {
+		t.Errorf("Expected 1 host and plugin, got %+v", result)
+	}
+
+	// Test rejections are counted
+	vars := fetchExpvar(t, apiConfig.Bind)
+	counters := vars["coco"].(map[string]interface{})["cardinality"].(map[string]interface{})
+	if counters["exceeded"] != float64(2) || counters["rejected"] != float64(2) {
+		t.Errorf("Expected 2 rejected metrics, got %+v", counters)
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco-rules")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rules.json")
+
+	rules, err := coco.NewFilterRules(path)
+	if err != nil {
+		t.Fatalf("Couldn't set up rules: %s", err)
+	}
+	apiConfig := coco.ApiConfig{
+		Bind:  "127.0.0.1:26821",
+		Rules: rules,
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	config := coco.FilterConfig{
+		Blacklist: "/(vmem|irq|entropy|users)/",
+		Rules:     rules,
+	}
+	raw := make(chan collectd.Packet)
+	filtered := make(chan collectd.Packet, 100)
+	blacklist := make(chan coco.BlacklistItem, 100)
+	go coco.Filter(config, raw, filtered, blacklist)
+
+	url := "http://" + apiConfig.Bind + "/filters"
+	post := func(body string) int {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("HTTP POST failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	remove := func(id string) int {
+		req, _ := http.NewRequest("DELETE", url+"/"+id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("HTTP DELETE failed: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	docker := collectd.Packet{Hostname: "foo", Plugin: "docker", PluginInstance: "abc123", Type: "cpu"}
+	load := collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"}
+	// filter sends samples through Filter, and returns the plugins accepted
+	filter := func() map[string]bool {
+		raw <- docker
+		raw <- load
+		time.Sleep(10 * time.Millisecond)
+		accepted := map[string]bool{}
+		for len(filtered) > 0 {
+			accepted[(<-filtered).Plugin] = true
+		}
+		return accepted
+	}
+
+	// Test rules are validated before they're applied
+	for _, body := range []string{`{"pattern": "("}`, `{"pattern": ""}`, `not json`} {
+		if code := post(body); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, code)
+		}
+	}
+
+	// Test rules are applied without restarting Filter
+	if code := post(`{"pattern": "/docker/"}`); code != http.StatusCreated {
+		t.Fatalf("Expected rule to be created, got %d", code)
+	}
+	if code := post(`{"pattern": "/docker/"}`); code != http.StatusConflict {
+		t.Errorf("Expected duplicate rule to conflict, got %d", code)
+	}
+	if accepted := filter(); accepted["docker"] || !accepted["load"] {
+		t.Errorf("Expected docker to be blacklisted, got %+v", accepted)
+	}
+	if len(blacklist) != 1 {
+		t.Errorf("Expected docker to be added to the blacklist, got %d items", len(blacklist))
+	}
+
+	// Test rules are listed
+	var list []coco.FilterRule
+	fetchJSON(t, url, &list)
+	if len(list) != 1 || list[0].ID != 1 || list[0].Pattern != "/docker/" {
+		t.Errorf("Expected docker rule to be listed, got %+v", list)
+	}
+
+	// Test rules are saved
+	saved, err := coco.NewFilterRules(path)
+	if err != nil {
+		t.Fatalf("Couldn't load saved rules: %s", err)
+	}
+	if !saved.Match("foo/docker/abc123/cpu") {
+		t.Errorf("Expected docker rule to be saved, got %+v", saved.List())
+	}
+
+	// Test rules are removed
+	if code := remove("1"); code != http.StatusNoContent {
+		t.Errorf("Expected rule to be removed, got %d", code)
+	}
+	if code := remove("1"); code != http.StatusNotFound {
+		t.Errorf("Expected removed rule to be gone, got %d", code)
+	}
+	if accepted := filter(); !accepted["docker"] || !accepted["load"] {
+		t.Errorf("Expected docker to be accepted, got %+v", accepted)
+	}
+}
+
+func TestFilterSurvivesPanics(t *testing.T) {
+	config := coco.FilterConfig{
+		Blacklist: "/(vmem|irq|entropy|users)/",
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected blacklist to be valid: %s", err)
+	}
+	invalid := coco.FilterConfig{Blacklist: "/(vmem|irq"}
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("Expected %s to be an invalid blacklist", invalid.Blacklist)
+	}
+
+	raw := make(chan collectd.Packet)
+	filtered := make(chan collectd.Packet, 10)
+	// Queueing blacklisted samples panics
+	blacklist := make(chan coco.BlacklistItem)
+	close(blacklist)
+	go coco.Filter(config, raw, filtered, blacklist)
+
+	raw <- collectd.Packet{Hostname: "foo", Plugin: "irq", Type: "irq", TypeInstance: "7"}
+	raw <- collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"}
+
+	// Test the worker carries on after the panic
+	select {
+	case p := <-filtered:
+		if p.Plugin != "load" {
+			t.Errorf("Expected load sample to be accepted, got %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Filter to keep running after a panic")
+	}
+}
+
+func BenchmarkFilter(b *testing.B) {
+	config := coco.FilterConfig{
+		Blacklist: "/(vmem|irq|entropy|users)/",
+	}
+	raw := make(chan collectd.Packet, 1000)
+	filtered := make(chan collectd.Packet, 1000)
+	blacklist := make(chan coco.BlacklistItem, 1000)
+	go coco.Filter(config, raw, filtered, blacklist)
+
+	packets := []collectd.Packet{
+		collectd.Packet{Hostname: "foo", Plugin: "memory", Type: "memory", TypeInstance: "free"},
+		collectd.Packet{Hostname: "foo", Plugin: "irq", Type: "irq", TypeInstance: "7"},
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			select {
+			case <-filtered:
+			case <-blacklist:
+			}
+		}
+		done <- true
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		raw <- packets[i%len(packets)]
+	}
+	<-done
+}
+
 // Test that we can generate a metric name
 func TestGenerateMetricName(t *testing.T) {
 	packet := collectd.Packet{
@@ -144,6 +469,39 @@ func TestTierInitialisation(t *testing.T) {
 	}
 }
 
+func TestTierFetchURL(t *testing.T) {
+	tier := coco.Tier{
+		Name:    "a",
+		Targets: []string{"alice:25826", "bob:25826", "carol:25826", "dan:25826"},
+		Endpoints: map[string]coco.EndpointConfig{
+			"bob:25826":   coco.EndpointConfig{Port: "8080"},
+			"carol:25826": coco.EndpointConfig{Scheme: "https", Host: "carol.example", PathPrefix: "/visage/"},
+			"dan:25826":   coco.EndpointConfig{URL: "https://dan.example:8443/visage/"},
+		},
+	}
+
+	tests := []struct {
+		target string
+		host   string
+		url    string
+	}{
+		{"alice:25826", "alice:29292", "http://alice:29292/data/foo/load/load"},
+		{"bob:25826", "bob:8080", "http://bob:8080/data/foo/load/load"},
+		{"carol:25826", "carol.example", "https://carol.example/visage/data/foo/load/load"},
+		{"dan:25826", "dan.example:8443", "https://dan.example:8443/visage/data/foo/load/load"},
+	}
+
+	for _, test := range tests {
+		host, url := tier.FetchURL(test.target, "29292", "/data/foo/load/load")
+		if host != test.host {
+			t.Errorf("Expected host %s for %s, got %s", test.host, test.target, host)
+		}
+		if url != test.url {
+			t.Errorf("Expected URL %s for %s, got %s", test.url, test.target, url)
+		}
+	}
+}
+
 func TestSendWhenMissingConnection(t *testing.T) {
 	// Setup tiers
 	tierConfig := make(map[string]coco.TierConfig)
@@ -220,7 +578,7 @@ func TestSend(t *testing.T) {
 	// Setup listener
 	listenConfig := coco.ListenConfig{
 		Bind:    "127.0.0.1:25887",
-		Typesdb: "../types.db",
+		Typesdb: coco.TypesDB{"../types.db"},
 	}
 	samples := make(chan collectd.Packet)
 	go coco.Listen(listenConfig, samples)
@@ -272,7 +630,7 @@ func TestSendTiers(t *testing.T) {
 	// Setup listen
 	listenConfig := coco.ListenConfig{
 		Bind:    "127.0.0.1:25888",
-		Typesdb: "../types.db",
+		Typesdb: coco.TypesDB{"../types.db"},
 	}
 	raw := make(chan collectd.Packet)
 	go coco.Listen(listenConfig, raw)
@@ -714,3 +1072,1679 @@ func TestBlacklisted(t *testing.T) {
 		t.Errorf("Expected %d blacklisted metrics, got %d", count, expected)
 	}
 }
+
+func TestDiscovery(t *testing.T) {
+	// Setup tiers
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25841", "127.0.0.1:25842"}}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tiers = append(tiers, tier)
+	}
+
+	// Setup Send
+	filtered := make(chan collectd.Packet)
+	go coco.Send(&tiers, filtered)
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26811",
+	}
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	// Push packets to Send
+	for _, host := range []string{"foo", "bar", "baz"} {
+		for _, plugin := range []string{"load", "memory", "cpu"} {
+			filtered <- collectd.Packet{
+				Hostname: host,
+				Plugin:   plugin,
+				Type:     plugin,
+			}
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Test listing hosts
+	var hosts coco.HostsJSON
+	fetchJSON(t, "http://127.0.0.1:26811/hosts?offset=1&limit=1", &hosts)
+	if hosts.Total != 3 || len(hosts.Hosts) != 1 {
+		t.Fatalf("Expected 1 of 3 hosts, got: %+v", hosts)
+	}
+	host := hosts.Hosts[0]
+	if host.Host != "baz" || host.Metrics != 3 || host.LastSeen == 0 || host.Targets["a"] == "" {
+		t.Errorf("Unexpected host: %+v", host)
+	}
+
+	// Test listing metrics for a host
+	var metrics coco.MetricsJSON
+	fetchJSON(t, "http://127.0.0.1:26811/hosts/foo/metrics", &metrics)
+	if metrics.Total != 3 || len(metrics.Metrics) != 3 {
+		t.Fatalf("Expected 3 metrics, got: %+v", metrics)
+	}
+	if metrics.Metrics[0].Name != "cpu/cpu" || metrics.Metrics[0].LastSeen == 0 {
+		t.Errorf("Unexpected metric: %+v", metrics.Metrics[0])
+	}
+
+	resp, err := http.Get("http://127.0.0.1:26811/hosts/qux/metrics")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown host, got %d", resp.StatusCode)
+	}
+
+	// Test searching
+	var results coco.MetricsJSON
+	fetchJSON(t, "http://127.0.0.1:26811/search?q=^ba.*/load", &results)
+	if results.Total != 2 || len(results.Metrics) != 2 {
+		t.Fatalf("Expected 2 results, got: %+v", results)
+	}
+	for _, m := range results.Metrics {
+		if m.Name != "load/load" {
+			t.Errorf("Unexpected search result: %+v", m)
+		}
+	}
+}
+
+func TestStaleAndExpire(t *testing.T) {
+	// Setup tiers
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25843"}}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tiers = append(tiers, tier)
+	}
+	coco.BuildTiers(&tiers)
+
+	// Populate routes and blacklisted metrics as if they were seen a while ago
+	now := time.Now().Unix()
+	tiers[0].Mappings["127.0.0.1:25843"] = map[string]map[string]int64{
+		"alive": {"load/load": now, "memory/memory/free": now - 600},
+		"dying": {"load/load": now - 600, "memory/memory/free": now - 900},
+		"dead":  {"load/load": now - 7200},
+	}
+	blacklisted := map[string]map[string]int64{
+		"alive": {"irq/irq/0": now},
+		"dead":  {"irq/irq/0": now - 7200},
+	}
+
+	// Setup Api
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26812",
+	}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	// Test finding stale hosts and metrics
+	var stale coco.StaleJSON
+	fetchJSON(t, "http://127.0.0.1:26812/stale?after=5m&within=1h", &stale)
+	if len(stale.Hosts) != 1 || stale.Hosts[0].Host != "dying" {
+		t.Errorf("Expected only 'dying' to be a stale host, got: %+v", stale.Hosts)
+	}
+	if len(stale.Metrics) != 1 || stale.Metrics[0].Host != "alive" || stale.Metrics[0].Name != "memory/memory/free" {
+		t.Errorf("Expected only alive/memory/memory/free to be a stale metric, got: %+v", stale.Metrics)
+	}
+
+	// Setup Expire
+	expireConfig := coco.ExpireConfig{
+		TTL:          *new(coco.Duration),
+		TickInterval: *new(coco.Duration),
+	}
+	expireConfig.TTL.UnmarshalText([]byte("1h"))
+	expireConfig.TickInterval.UnmarshalText([]byte("10ms"))
+	go coco.Expire(expireConfig, &tiers, &blacklisted)
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Test expired hosts have been removed
+	var hosts coco.HostsJSON
+	fetchJSON(t, "http://127.0.0.1:26812/hosts", &hosts)
+	if hosts.Total != 2 {
+		t.Errorf("Expected 2 hosts after expiry, got: %+v", hosts)
+	}
+	var result map[string]interface{}
+	fetchJSON(t, "http://127.0.0.1:26812/blacklisted", &result)
+	if len(result) != 1 || result["alive"] == nil {
+		t.Errorf("Expected only 'alive' to be blacklisted after expiry, got: %+v", result)
+	}
+}
+
+func TestPersistAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Setup tiers
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25844", "127.0.0.1:25845"}}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tiers = append(tiers, tier)
+	}
+	coco.BuildTiers(&tiers)
+
+	now := time.Now().Unix()
+	tiers[0].Mappings["127.0.0.1:25844"]["foo"] = map[string]int64{"load/load": now}
+	tiers[0].Mappings["127.0.0.1:25845"]["bar"] = map[string]int64{"load/load": now}
+	// Some of these hash to the other target
+	hosts := []string{"baz", "qux", "quux", "corge", "grault", "garply"}
+	for _, host := range hosts {
+		tiers[0].Mappings["127.0.0.1:25844"][host] = map[string]int64{"load/load": now}
+	}
+	blacklisted := map[string]map[string]int64{
+		"foo": {"irq/irq/0": now},
+	}
+
+	// Setup Persist
+	persistConfig := coco.PersistConfig{
+		Path:         filepath.Join(dir, "state.json"),
+		TickInterval: *new(coco.Duration),
+	}
+	persistConfig.TickInterval.UnmarshalText([]byte("10ms"))
+	go coco.Persist(persistConfig, &tiers, &blacklisted)
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Restore into a tier that has lost a target
+	restoredConfig := coco.TierConfig{Targets: []string{"127.0.0.1:25844"}}
+	restored := []coco.Tier{coco.Tier{Name: "a", Targets: restoredConfig.Targets}}
+	restoredBlacklisted := map[string]map[string]int64{}
+	coco.Restore(persistConfig, &restored, &restoredBlacklisted)
+	coco.BuildTiers(&restored)
+
+	// Test
+	if restored[0].Mappings["127.0.0.1:25844"]["foo"]["load/load"] != now {
+		t.Errorf("Expected routes to be restored, got: %+v", restored[0].Mappings)
+	}
+	if restored[0].Mappings["127.0.0.1:25845"] != nil {
+		t.Errorf("Expected routes to removed target to be dropped, got: %+v", restored[0].Mappings)
+	}
+	if restoredBlacklisted["foo"]["irq/irq/0"] != now {
+		t.Errorf("Expected blacklisted metrics to be restored, got: %+v", restoredBlacklisted)
+	}
+
+	// Test routes are dropped for hosts that no longer hash to their target
+	resharded := []coco.Tier{coco.Tier{Name: "a", Targets: tierConfig["a"].Targets}}
+	coco.Restore(persistConfig, &resharded, &restoredBlacklisted)
+	coco.BuildTiers(&resharded)
+	kept := 0
+	for target, routes := range resharded[0].Mappings {
+		for host, _ := range routes {
+			if owner, _ := resharded[0].Lookup(host); owner != target {
+				t.Errorf("Expected route for %s to %s to be dropped, as it hashes to %s", host, target, owner)
+			}
+			kept += 1
+		}
+	}
+	if kept == 0 || kept == len(hosts)+2 {
+		t.Errorf("Expected some of %d restored routes to be dropped, kept %d: %+v", len(hosts)+2, kept, resharded[0].Mappings)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	spillConfig := coco.SpillConfig{
+		Path:          dir,
+		RetryInterval: coco.Duration{Duration: 10 * time.Millisecond},
+	}
+	target := "127.0.0.1:25847"
+
+	// Spill some packets while the target is down
+	spool, err := coco.NewSpool(spillConfig, "a", target)
+	if err != nil {
+		t.Fatalf("Couldn't create spool: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		spool.Append(encode(t, collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "load",
+			Type:     "load",
+		}))
+	}
+	if !spool.Spilling() {
+		t.Errorf("Expected spool to be spilling")
+	}
+
+	// Test spilled packets survive a restart
+	spool, err = coco.NewSpool(spillConfig, "a", target)
+	if err != nil {
+		t.Fatalf("Couldn't reopen spool: %s", err)
+	}
+	stats := spool.Stats().(map[string]int64)
+	if stats["packets"] != 3 || stats["bytes"] == 0 {
+		t.Fatalf("Expected 3 packets to be spilled, got: %+v", stats)
+	}
+
+	// Bring the target up, and replay to it
+	laddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatal("Couldn't resolve address", err)
+	}
+	listener, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Couldn't listen to %s: %s", target, err)
+	}
+	defer listener.Close()
+	go spool.Replay(nil)
+
+	count := 0
+	buf := make([]byte, 1452)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for count < 3 {
+		if _, err := listener.Read(buf); err != nil {
+			t.Fatalf("Expected 3 packets to be replayed, got %d: %s", count, err)
+		}
+		count += 1
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	stats = spool.Stats().(map[string]int64)
+	if stats["packets"] != 0 || stats["replayed"] != 3 || spool.Spilling() {
+		t.Errorf("Expected spool to be drained, got: %+v", stats)
+	}
+	info, err := os.Stat(spool.Path)
+	if err != nil || info.Size() != 0 {
+		t.Errorf("Expected spool to be truncated, got: %+v, %s", info, err)
+	}
+}
+
+// Test live packets aren't held back by a backlog, the backlog is bounded, and
+// packets that can never be written don't block replay
+func TestSpillRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := "127.0.0.1:25864"
+	payload := encode(t, collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"})
+	record := int64(12 + len(payload))
+	spillConfig := coco.SpillConfig{
+		Path:          dir,
+		MaxBytes:      5 * record,
+		ReplayRate:    10,
+		RetryInterval: coco.Duration{Duration: 10 * time.Millisecond},
+	}
+
+	// Spill a packet that can never be written, left over from before a
+	// restart
+	path := filepath.Join(dir, "b", "127.0.0.1_25864.spill")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Couldn't create spool directory: %s", err)
+	}
+	oversize := make([]byte, 12+70000)
+	binary.BigEndian.PutUint64(oversize[0:8], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint32(oversize[8:12], 70000)
+	if err := ioutil.WriteFile(path, oversize, 0644); err != nil {
+		t.Fatalf("Couldn't write spool: %s", err)
+	}
+	spool, err := coco.NewSpool(coco.SpillConfig{Path: dir, RetryInterval: spillConfig.RetryInterval}, "b", target)
+	if err != nil {
+		t.Fatalf("Couldn't create spool: %s", err)
+	}
+	if spool.Append(make([]byte, 70000)) {
+		t.Errorf("Expected packet larger than a datagram not to be spilled")
+	}
+	if !spool.Append(payload) {
+		t.Fatalf("Expected packet to be spilled")
+	}
+
+	// Bring the target up, and replay to it
+	laddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatal("Couldn't resolve address", err)
+	}
+	listener, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Couldn't listen to %s: %s", target, err)
+	}
+	defer listener.Close()
+	go spool.Replay(nil)
+
+	buf := make([]byte, 1452)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := listener.Read(buf); err != nil {
+		t.Fatalf("Expected packet after the oversize packet to be replayed: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	stats := spool.Stats().(map[string]int64)
+	if stats["replayed"] != 1 || stats["dropped"] != 2 {
+		t.Errorf("Expected oversize packets to be dropped, got: %+v", stats)
+	}
+
+	// Spill a backlog, and test live packets are written to the target once
+	// it's retried, while the backlog is still being replayed
+	spool, err = coco.NewSpool(spillConfig, "a", target)
+	if err != nil {
+		t.Fatalf("Couldn't create spool: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if !spool.Append(payload) {
+			t.Fatalf("Expected packet %d to be spilled", i)
+		}
+	}
+	if spool.Append(payload) {
+		t.Errorf("Expected packet to be dropped when the spool is full")
+	}
+	go spool.Replay(nil)
+	time.Sleep(50 * time.Millisecond)
+	stats = spool.Stats().(map[string]int64)
+	if spool.Spilling() || stats["packets"] == 0 {
+		t.Errorf("Expected live packets to be written while the backlog is replayed, got: %+v", stats)
+	}
+
+	// Test replayed packets don't count towards the limit
+	for spool.Stats().(map[string]int64)["replayed"] < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if !spool.Append(payload) {
+			t.Errorf("Expected packet %d to be spilled once the backlog was partly replayed", i)
+		}
+	}
+	info, err := os.Stat(spool.Path)
+	if err != nil || info.Size() > spillConfig.MaxBytes {
+		t.Errorf("Expected spool to be compacted to at most %d bytes, got: %+v, %s", spillConfig.MaxBytes, info, err)
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	// Test validation
+	invalid := []coco.QueueConfig{
+		coco.QueueConfig{Size: -1},
+		coco.QueueConfig{Policy: "drop-everything"},
+	}
+	for _, q := range invalid {
+		if err := q.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", q)
+		}
+	}
+
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26813",
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	hosts := []string{"a", "b", "c", "d", "e"}
+	cases := map[string][]string{
+		coco.OverflowDropNewest: []string{"a", "b"},
+		coco.OverflowDropOldest: []string{"d", "e"},
+	}
+	var expected float64
+	for policy, kept := range cases {
+		config := coco.FilterConfig{
+			Blacklist: "/(vmem|irq|entropy|users)/",
+			Filtered:  coco.QueueConfig{Size: 2, Policy: policy},
+		}
+		raw := make(chan collectd.Packet)
+		filtered := make(chan collectd.Packet, config.Filtered.Capacity())
+		items := make(chan coco.BlacklistItem, 1000)
+		go coco.Filter(config, raw, filtered, items)
+
+		// Overflow the queue
+		for _, host := range hosts {
+			raw <- collectd.Packet{Hostname: host, Plugin: "load", Type: "load"}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		// Test the right samples were kept
+		if len(filtered) != len(kept) {
+			t.Fatalf("Expected %d samples to be queued with %s, got %d", len(kept), policy, len(filtered))
+		}
+		for _, host := range kept {
+			p := <-filtered
+			if p.Hostname != host {
+				t.Errorf("Expected %s to be kept with %s, got %s", host, policy, p.Hostname)
+			}
+		}
+
+		// Test the drops were counted
+		expected += 3
+		vars := fetchExpvar(t, apiConfig.Bind)
+		actual := vars["coco"].(map[string]interface{})["dropped"].(map[string]interface{})["filtered"].(float64)
+		if actual != expected {
+			t.Errorf("Expected coco.dropped.filtered to be %.0f with %s, was %.0f", expected, policy, actual)
+		}
+	}
+
+	// Test the blacklist queue overflows the same way
+	config := coco.FilterConfig{
+		Blacklist:   "/(vmem|irq|entropy|users)/",
+		Blacklisted: coco.QueueConfig{Size: 1, Policy: coco.OverflowDropNewest},
+	}
+	raw := make(chan collectd.Packet)
+	items := make(chan coco.BlacklistItem, config.Blacklisted.Capacity())
+	go coco.Filter(config, raw, make(chan collectd.Packet, 10), items)
+	for _, host := range hosts[0:3] {
+		raw <- collectd.Packet{Hostname: host, Plugin: "users", Type: "users"}
+	}
+	time.Sleep(10 * time.Millisecond)
+	vars := fetchExpvar(t, apiConfig.Bind)
+	if actual := vars["coco"].(map[string]interface{})["dropped"].(map[string]interface{})["blacklist"]; actual != 2.0 {
+		t.Errorf("Expected coco.dropped.blacklist to be 2, was %v", actual)
+	}
+
+	// Test the notifications queue is small and drops by default
+	queues := coco.QueuesConfig{}
+	if q := queues.NotificationsQueue(); q.Capacity() != 10000 || q.Overflow() != coco.OverflowDropNewest {
+		t.Errorf("Expected notifications queue to default to 10000 with drop-newest, got %+v", q)
+	}
+}
+
+func TestListenSockets(t *testing.T) {
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26814",
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	// Setup listener
+	listenConfig := coco.ListenConfig{
+		Bind:       "127.0.0.1:25848",
+		Typesdb:    coco.TypesDB{"../types.db"},
+		Sockets:    4,
+		ReadBuffer: 1048576,
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	time.Sleep(50 * time.Millisecond)
+
+	// Send from many source ports, so datagrams are spread across sockets
+	count := 20
+	for i := 0; i < count; i++ {
+		conn, err := net.Dial("udp", listenConfig.Bind)
+		if err != nil {
+			t.Fatalf("Couldn't dial %s: %s", listenConfig.Bind, err)
+		}
+		conn.Write(encode(t, collectd.Packet{
+			Hostname: "host-" + strconv.Itoa(i),
+			Plugin:   "load",
+			Type:     "load",
+		}))
+		conn.Close()
+	}
+
+	// Test every packet is received once
+	received := map[string]bool{}
+	timeout := time.After(time.Second)
+	for len(received) < count {
+		select {
+		case p := <-raw:
+			received[p.Hostname] = true
+		case <-timeout:
+			t.Fatalf("Expected %d packets to be received, got %d", count, len(received))
+		}
+	}
+
+	// Test kernel drops are exposed
+	vars := fetchExpvar(t, apiConfig.Bind)
+	if _, ok := vars["coco"].(map[string]interface{})["listen"].(map[string]interface{})["kernel_drops"]; !ok {
+		t.Errorf("Expected coco.listen.kernel_drops to be exposed, got: %+v", vars["coco"])
+	}
+}
+
+func TestListenMaxPacketSize(t *testing.T) {
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26815",
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	// Setup listener
+	listenConfig := coco.ListenConfig{
+		Bind:          "127.0.0.1:25849",
+		Typesdb:       coco.TypesDB{"../types.db"},
+		MaxPacketSize: 64,
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", listenConfig.Bind, err)
+	}
+	defer conn.Close()
+
+	// Send a datagram larger than the max packet size, then one that fits
+	long := collectd.Packet{Hostname: strings.Repeat("a", 64), Plugin: "load", Type: "load"}
+	short := collectd.Packet{Hostname: "b", Plugin: "load", Type: "load"}
+	conn.Write(encode(t, long))
+	conn.Write(encode(t, short))
+
+	select {
+	case p := <-raw:
+		if p.Hostname != short.Hostname {
+			t.Errorf("Expected truncated datagram to be dropped, got %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a packet to be received")
+	}
+
+	vars := fetchExpvar(t, apiConfig.Bind)
+	actual := vars["coco"].(map[string]interface{})["errors"].(map[string]interface{})["listen.truncated"].(float64)
+	if actual != 1 {
+		t.Errorf("Expected coco.errors.listen.truncated to be 1, was %.0f", actual)
+	}
+}
+
+func TestSendBatching(t *testing.T) {
+	// Setup target
+	target := "127.0.0.1:25850"
+	laddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatal("Couldn't resolve address", err)
+	}
+	listener, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Couldn't listen to %s: %s", target, err)
+	}
+	defer listener.Close()
+
+	// Setup sender
+	batch := coco.BatchConfig{
+		MaxPacketSize: 200,
+		FlushInterval: coco.Duration{Duration: 20 * time.Millisecond},
+	}
+	tiers := []coco.Tier{
+		coco.Tier{Name: "a", Targets: []string{target}, Batch: batch},
+	}
+	filtered := make(chan collectd.Packet)
+	go coco.Send(&tiers, filtered)
+
+	count := 10
+	for i := 0; i < count; i++ {
+		filtered <- collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "load",
+			Type:     "load",
+			Values:   []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: float64(i)}},
+		}
+	}
+
+	types, err := collectd.TypesDBFile("../types.db")
+	if err != nil {
+		t.Fatalf("Couldn't parse types.db: %s", err)
+	}
+
+	// Test the samples are batched into datagrams no larger than the max
+	datagrams, samples := 0, 0
+	buf := make([]byte, 1452)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for samples < count {
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatalf("Expected %d samples to be received, got %d: %s", count, samples, err)
+		}
+		if n > batch.MaxPacketSize {
+			t.Errorf("Expected datagram to be no larger than %d bytes, was %d", batch.MaxPacketSize, n)
+		}
+		packets, err := collectd.Packets(buf[0:n], types)
+		if err != nil {
+			t.Fatalf("Couldn't decode datagram: %s", err)
+		}
+		for _, p := range *packets {
+			if p.Values[0].Value != float64(samples) {
+				t.Errorf("Expected sample %d to arrive in order, got %+v", samples, p)
+			}
+			samples += 1
+		}
+		datagrams += 1
+	}
+	if datagrams >= count {
+		t.Errorf("Expected %d samples to be batched into fewer datagrams, got %d", count, datagrams)
+	}
+}
+
+func TestListenDecodeErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coco")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26816",
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	// Setup listener
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25851",
+		Typesdb: coco.TypesDB{"../types.db"},
+		Capture: filepath.Join(dir, "bad.log"),
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", listenConfig.Bind, err)
+	}
+	defer conn.Close()
+
+	gauge := collectd.Value{Type: collectd.TypeGauge, Value: 1.0}
+	packet := collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load"}
+
+	// A part shorter than its header
+	conn.Write([]byte{0, 0, 0, 1})
+	// More values than there are bytes for
+	packet.Values = []collectd.Value{gauge}
+	truncated := encode(t, packet)
+	truncated[len(truncated)-10] = 2
+	conn.Write(truncated)
+	// More values than load has data sources in types.db
+	packet.Values = []collectd.Value{gauge, gauge, gauge, gauge}
+	conn.Write(encode(t, packet))
+	// A valid packet
+	packet.Values = []collectd.Value{gauge, gauge, gauge}
+	conn.Write(encode(t, packet))
+
+	// Test the listener survives, and the valid packet gets through
+	select {
+	case p := <-raw:
+		if len(p.Values) != 3 {
+			t.Errorf("Expected only the valid packet to be decoded, got %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a packet to be received")
+	}
+
+	// Test the failures are counted by reason
+	vars := fetchExpvar(t, apiConfig.Bind)
+	errors := vars["coco"].(map[string]interface{})["errors"].(map[string]interface{})
+	for _, reason := range []string{"malformed", "truncated", "unknown_type"} {
+		actual := errors["listen.decode."+reason].(float64)
+		if actual != 1 {
+			t.Errorf("Expected coco.errors.listen.decode.%s to be 1, was %.0f", reason, actual)
+		}
+	}
+
+	// Test the bad packets were captured
+	data, err := ioutil.ReadFile(listenConfig.Capture)
+	if err != nil {
+		t.Fatalf("Couldn't read capture file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 bad packets to be captured, got: %s", data)
+	}
+	if !strings.Contains(lines[0], " malformed 00000001") {
+		t.Errorf("Expected capture to contain reason and payload, got: %s", lines[0])
+	}
+}
+
+func TestListenersConfig(t *testing.T) {
+	single := `
+[listen]
+bind = "0.0.0.0:25826"
+typesdb = "types.db"
+`
+	multiple := `
+[[listen]]
+bind = "0.0.0.0:25826"
+typesdb = ["types.db", "custom.db"]
+
+[[listen]]
+bind = "0.0.0.0:8080"
+protocol = "write_http"
+[listen.tags]
+plugin_instance = "app"
+`
+	var config coco.Config
+	if _, err := toml.Decode(single, &config); err != nil {
+		t.Fatalf("Couldn't decode single listener: %s", err)
+	}
+	if len(config.Listen) != 1 || config.Listen[0].Bind != "0.0.0.0:25826" {
+		t.Errorf("Expected a single listener, got %+v", config.Listen)
+	}
+	if len(config.Listen[0].Typesdb) != 1 || config.Listen[0].Typesdb[0] != "types.db" {
+		t.Errorf("Expected a single types.db, got %+v", config.Listen[0].Typesdb)
+	}
+
+	config = coco.Config{}
+	if _, err := toml.Decode(multiple, &config); err != nil {
+		t.Fatalf("Couldn't decode multiple listeners: %s", err)
+	}
+	if len(config.Listen) != 2 {
+		t.Fatalf("Expected 2 listeners, got %+v", config.Listen)
+	}
+	if len(config.Listen[0].Typesdb) != 2 || config.Listen[0].Typesdb[1] != "custom.db" {
+		t.Errorf("Expected 2 types.db files, got %+v", config.Listen[0].Typesdb)
+	}
+	if config.Listen[1].Protocol != coco.ProtocolWriteHTTP || config.Listen[1].Tags["plugin_instance"] != "app" {
+		t.Errorf("Expected write_http listener with tags, got %+v", config.Listen[1])
+	}
+
+	invalid := []coco.ListenConfig{
+		coco.ListenConfig{Protocol: "carrier-pigeon"},
+		coco.ListenConfig{Tags: map[string]string{"colour": "blue"}},
+	}
+	for _, l := range invalid {
+		if err := l.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", l)
+		}
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	listenConfig := coco.ListenConfig{
+		Bind:     "127.0.0.1:25852",
+		Typesdb:  coco.TypesDB{"../types.db"},
+		Protocol: coco.ProtocolCollectdTCP,
+		Tags:     map[string]string{"plugin_instance": "app"},
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	poll(t, listenConfig.Bind)
+
+	conn, err := net.Dial("tcp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", listenConfig.Bind, err)
+	}
+	defer conn.Close()
+
+	// Stream samples, split across writes at arbitrary points
+	gauge := collectd.Value{Type: collectd.TypeGauge, Value: 1.0}
+	var stream []byte
+	for _, host := range []string{"a", "b", "c"} {
+		stream = append(stream, encode(t, collectd.Packet{
+			Hostname: host,
+			Plugin:   "load",
+			Type:     "load",
+			Values:   []collectd.Value{gauge, gauge, gauge},
+		})...)
+	}
+	conn.Write(stream[:7])
+	time.Sleep(10 * time.Millisecond)
+	conn.Write(stream[7:])
+
+	for _, host := range []string{"a", "b", "c"} {
+		select {
+		case p := <-raw:
+			if p.Hostname != host || len(p.Values) != 3 {
+				t.Errorf("Expected sample for %s, got %+v", host, p)
+			}
+			if p.PluginInstance != "app" {
+				t.Errorf("Expected default plugin_instance tag to be applied, got %+v", p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected sample for %s to be received", host)
+		}
+	}
+}
+
+func TestListenWriteHTTP(t *testing.T) {
+	listenConfig := coco.ListenConfig{
+		Bind:     "127.0.0.1:26817",
+		Protocol: coco.ProtocolWriteHTTP,
+		Tags:     map[string]string{"host": "default", "plugin_instance": "app"},
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	poll(t, listenConfig.Bind)
+
+	url := "http://" + listenConfig.Bind + "/collectd"
+	body := `[{"values":[1901474177,null],"dstypes":["counter","gauge"],"dsnames":["rx","tx"],"time":1280959128.25,"interval":10.0,"host":"leeloo","plugin":"interface","plugin_instance":"","type":"if_octets","type_instance":""}]`
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("HTTP POST failed: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	select {
+	case p := <-raw:
+		if p.Hostname != "leeloo" || p.Plugin != "interface" || p.Type != "if_octets" {
+			t.Errorf("Expected sample to be decoded, got %+v", p)
+		}
+		if p.PluginInstance != "app" {
+			t.Errorf("Expected default plugin_instance tag to be applied, got %+v", p)
+		}
+		if p.TimeHR>>30 != 1280959128 || p.IntervalHR>>30 != 10 {
+			t.Errorf("Expected high resolution time and interval, got %+v", p)
+		}
+		if len(p.Values) != 2 || p.Values[0].Value != 1901474177 || p.Values[0].Type != collectd.TypeCounter || p.Values[1].Name != "tx" {
+			t.Errorf("Expected values to be decoded, got %+v", p.Values)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected sample to be received")
+	}
+
+	// Test bad samples are rejected
+	for _, body := range []string{`{`, `[{"values":[1],"dstypes":["gauge"],"dsnames":[]}]`, `[{"values":[1],"dstypes":["bogus"],"dsnames":["value"]}]`} {
+		resp, err = http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("HTTP POST failed: %s", err)
+		}
+		if resp.StatusCode != 400 {
+			t.Errorf("Expected 400 for %s, got %d", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestGraphiteTemplates(t *testing.T) {
+	templates := []string{
+		"servers.* _.host.plugin.plugin_instance.type_instance*",
+		"apps.* _.plugin.type.type_instance.type_instance",
+		"host.plugin.type_instance*",
+	}
+	tests := map[string]collectd.Packet{
+		"servers.web01_example_com.nginx.main.requests.total": collectd.Packet{
+			Hostname: "web01.example.com", Plugin: "nginx", PluginInstance: "main", TypeInstance: "requests_total",
+		},
+		// Underscores in hostnames are doubled
+		"servers.web__01_example_com.nginx.main.requests.total": collectd.Packet{
+			Hostname: "web_01.example.com", Plugin: "nginx", PluginInstance: "main", TypeInstance: "requests_total",
+		},
+		"apps.billing.latency.p99.api": collectd.Packet{
+			Plugin: "billing", Type: "latency", TypeInstance: "p99_api",
+		},
+		"db01.mysql.threads": collectd.Packet{
+			Hostname: "db01", Plugin: "mysql", TypeInstance: "threads",
+		},
+	}
+
+	listenConfig := coco.ListenConfig{Protocol: coco.ProtocolGraphite, Templates: templates}
+	if err := listenConfig.Validate(); err != nil {
+		t.Fatalf("Expected templates to be valid: %s", err)
+	}
+	var parsed []coco.Template
+	for _, s := range templates {
+		template, _ := coco.ParseTemplate(s)
+		parsed = append(parsed, template)
+	}
+
+	for name, expected := range tests {
+		components := strings.Split(name, ".")
+		var actual collectd.Packet
+		for _, template := range parsed {
+			if template.Match(components) {
+				template.Apply(components, &actual)
+				break
+			}
+		}
+		if actual.Hostname != expected.Hostname || actual.Plugin != expected.Plugin || actual.PluginInstance != expected.PluginInstance || actual.Type != expected.Type || actual.TypeInstance != expected.TypeInstance {
+			t.Errorf("Expected %s to be mapped to %+v, got %+v", name, expected, actual)
+		}
+	}
+
+	invalid := []string{"host.type", "host.plugin.colour", "a b c"}
+	for _, s := range invalid {
+		if _, err := coco.ParseTemplate(s); err == nil {
+			t.Errorf("Expected template '%s' to be invalid", s)
+		}
+	}
+}
+
+func TestListenGraphiteAndStatsd(t *testing.T) {
+	graphiteConfig := coco.ListenConfig{
+		Bind:     "127.0.0.1:25853",
+		Protocol: coco.ProtocolGraphite,
+	}
+	statsdConfig := coco.ListenConfig{
+		Bind:      "127.0.0.1:25854",
+		Protocol:  coco.ProtocolStatsd,
+		Templates: []string{"plugin.type_instance*"},
+		Tags:      map[string]string{"host": "app01"},
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(graphiteConfig, raw)
+	go coco.Listen(statsdConfig, raw)
+	poll(t, graphiteConfig.Bind)
+	time.Sleep(50 * time.Millisecond)
+
+	receive := func() collectd.Packet {
+		select {
+		case p := <-raw:
+			return p
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a sample to be received")
+		}
+		return collectd.Packet{}
+	}
+
+	// Graphite over TCP, with a bad line in between good ones
+	conn, err := net.Dial("tcp", graphiteConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", graphiteConfig.Bind, err)
+	}
+	conn.Write([]byte("web01_example_com.load.shortterm 0.5 1437000000\nnonsense\nweb01_example_com.load.midterm 0.25\n"))
+	conn.Close()
+
+	p := receive()
+	if p.Hostname != "web01.example.com" || p.Plugin != "load" || p.Type != "gauge" || p.TypeInstance != "shortterm" || p.Time != 1437000000 || p.Values[0].Value != 0.5 {
+		t.Errorf("Expected Graphite line to be parsed, got %+v", p)
+	}
+	p = receive()
+	if p.TypeInstance != "midterm" || p.Time == 0 {
+		t.Errorf("Expected Graphite line without timestamp to be parsed, got %+v", p)
+	}
+
+	// StatsD over UDP, with many lines in one datagram
+	sconn, err := net.Dial("udp", statsdConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", statsdConfig.Bind, err)
+	}
+	defer sconn.Close()
+	sconn.Write([]byte("billing.invoices:5|c|@0.5\nbilling.queue:12|g\nbilling.render:320|ms"))
+
+	expected := []collectd.Packet{
+		collectd.Packet{Type: "absolute", TypeInstance: "invoices", Values: []collectd.Value{collectd.Value{Type: collectd.TypeAbsolute, Value: 10}}},
+		collectd.Packet{Type: "gauge", TypeInstance: "queue", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 12}}},
+		collectd.Packet{Type: "latency", TypeInstance: "render", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 320}}},
+	}
+	for _, e := range expected {
+		p := receive()
+		if p.Hostname != "app01" || p.Plugin != "billing" || p.Type != e.Type || p.TypeInstance != e.TypeInstance || p.Values[0].Type != e.Values[0].Type || p.Values[0].Value != e.Values[0].Value {
+			t.Errorf("Expected StatsD line to be parsed to %+v, got %+v", e, p)
+		}
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	// Setup targets
+	targets := []string{"127.0.0.1:25856", "127.0.0.1:25857", "127.0.0.1:25858"}
+	listeners := map[string]*net.UDPConn{}
+	for _, target := range targets {
+		laddr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			t.Fatal("Couldn't resolve address", err)
+		}
+		listener, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Fatalf("Couldn't listen to %s: %s", target, err)
+		}
+		defer listener.Close()
+		listeners[target] = listener
+	}
+
+	// Setup sender, with a routed and a broadcast tier
+	tiers := []coco.Tier{
+		coco.Tier{Name: "routed", Targets: targets[0:1]},
+		coco.Tier{Name: "broadcast", Targets: targets[1:3], Notifications: coco.NotifyBroadcast},
+	}
+	filtered := make(chan collectd.Packet)
+	notifications := make(chan coco.Notification, 100)
+	go coco.SendWorkers(coco.SendConfig{}, &tiers, filtered, notifications)
+
+	// Setup listener
+	listenConfig := coco.ListenConfig{
+		Bind:          "127.0.0.1:25855",
+		Typesdb:       coco.TypesDB{"../types.db"},
+		Notifications: notifications,
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	time.Sleep(50 * time.Millisecond)
+
+	notification := coco.Notification{
+		Packet: collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "load",
+			Type:     "load",
+			TimeHR:   1437000000 << 30,
+		},
+		Severity: coco.SeverityWarning,
+		Message:  "Host foo, plugin load type load: Data source \"shortterm\" is currently 4.2. That is above the warning threshold of 4.0.",
+	}
+	payload, err := coco.EncodeNotification(notification)
+	if err != nil {
+		t.Fatalf("Couldn't encode notification: %s", err)
+	}
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", listenConfig.Bind, err)
+	}
+	defer conn.Close()
+	conn.Write(payload)
+
+	// Test the notification arrives intact at every target
+	buf := make([]byte, 1452)
+	for target, listener := range listeners {
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatalf("Expected notification to be dispatched to %s: %s", target, err)
+		}
+		if !bytes.Equal(buf[:n], payload) {
+			t.Errorf("Expected notification dispatched to %s to be re-encoded intact, got %x", target, buf[:n])
+		}
+	}
+
+	// Test notifications aren't treated as samples
+	select {
+	case p := <-raw:
+		t.Errorf("Expected notification not to be decoded as a sample, got %+v", p)
+	default:
+	}
+}
+
+func TestTypesDBReload(t *testing.T) {
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26818",
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	dir, err := ioutil.TempDir("", "coco-typesdb")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	custom := filepath.Join(dir, "custom.db")
+	if err := ioutil.WriteFile(custom, []byte("app_requests\tcount:GAUGE:0:U\n"), 0644); err != nil {
+		t.Fatalf("Couldn't write custom types.db: %s", err)
+	}
+
+	// Setup listener
+	listenConfig := coco.ListenConfig{
+		Bind:    "127.0.0.1:25859",
+		Typesdb: coco.TypesDB{"../types.db", custom},
+	}
+	raw := make(chan collectd.Packet, 100)
+	go coco.Listen(listenConfig, raw)
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("udp", listenConfig.Bind)
+	if err != nil {
+		t.Fatalf("Couldn't dial %s: %s", listenConfig.Bind, err)
+	}
+	defer conn.Close()
+
+	gauge := collectd.Value{Type: collectd.TypeGauge, Value: 1.0}
+	receive := func(typ string) collectd.Packet {
+		conn.Write(encode(t, collectd.Packet{Hostname: "foo", Plugin: "app", Type: typ, Values: []collectd.Value{gauge}}))
+		select {
+		case p := <-raw:
+			return p
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %s sample to be received", typ)
+		}
+		return collectd.Packet{}
+	}
+
+	// Test types are decoded from every file
+	if p := receive("gauge"); p.Values[0].Name != "value" {
+		t.Errorf("Expected sample to be received, got %+v", p)
+	}
+	if p := receive("app_requests"); p.Values[0].Name != "count" {
+		t.Errorf("Expected app_requests to be decoded with custom types.db, got %+v", p)
+	}
+
+	// Test unknown types are counted, but still received
+	if p := receive("app_latency"); p.Values[0].Name != "" {
+		t.Errorf("Expected app_latency to be decoded without names, got %+v", p)
+	}
+	vars := fetchExpvar(t, apiConfig.Bind)
+	unknown := vars["coco"].(map[string]interface{})["unknown_types"].(map[string]interface{})
+	if unknown["app_latency"] != float64(1) {
+		t.Errorf("Expected unknown app_latency type to be counted, got %+v", unknown)
+	}
+
+	// Test types are reloaded
+	if err := ioutil.WriteFile(custom, []byte("app_latency\tseconds:GAUGE:0:U\n"), 0644); err != nil {
+		t.Fatalf("Couldn't write custom types.db: %s", err)
+	}
+	coco.ReloadTypesDB()
+	if p := receive("app_latency"); p.Values[0].Name != "seconds" {
+		t.Errorf("Expected app_latency to be decoded after reload, got %+v", p)
+	}
+
+	// Test the loaded types are kept if types.db can't be parsed
+	if err := ioutil.WriteFile(custom, []byte("app_latency\n"), 0644); err != nil {
+		t.Fatalf("Couldn't write custom types.db: %s", err)
+	}
+	coco.ReloadTypesDB()
+	if p := receive("app_latency"); p.Values[0].Name != "seconds" {
+		t.Errorf("Expected types to be kept after failed reload, got %+v", p)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	apiConfig := coco.ApiConfig{
+		Bind: "127.0.0.1:26822",
+	}
+	var tiers []coco.Tier
+	blacklisted := map[string]map[string]int64{}
+	go coco.Api(apiConfig, &tiers, &blacklisted)
+	poll(t, apiConfig.Bind)
+
+	measureConfig := coco.MeasureConfig{
+		TickInterval: coco.Duration{Duration: 10 * time.Millisecond},
+	}
+	go coco.Measure(measureConfig, map[string]chan collectd.Packet{}, &tiers)
+
+	// Setup target
+	target := "127.0.0.1:25861"
+	laddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		t.Fatal("Couldn't resolve address", err)
+	}
+	listener, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatalf("Couldn't listen to %s: %s", target, err)
+	}
+	defer listener.Close()
+
+	// Setup sender with many workers sharing batches
+	tiers = []coco.Tier{
+		coco.Tier{
+			Name:    "a",
+			Targets: []string{target},
+			Batch:   coco.BatchConfig{MaxPacketSize: 1452, FlushInterval: coco.Duration{Duration: 10 * time.Millisecond}},
+		},
+	}
+	filtered := make(chan collectd.Packet)
+	go coco.SendWorkers(coco.SendConfig{Workers: 3}, &tiers, filtered, nil)
+
+	count := 300
+	for i := 0; i < count; i++ {
+		filtered <- collectd.Packet{
+			Hostname: "host-" + strconv.Itoa(i),
+			Plugin:   "load",
+			Type:     "load",
+			Values:   []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 1.0}},
+		}
+	}
+
+	// Test every sample is dispatched once
+	samples := 0
+	buf := make([]byte, 1452)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	for samples < count {
+		n, err := listener.Read(buf)
+		if err != nil {
+			t.Fatalf("Expected %d samples to be received, got %d: %s", count, samples, err)
+		}
+		packets, err := collectd.Packets(buf[0:n], nil)
+		if err != nil {
+			t.Fatalf("Couldn't decode datagram: %s", err)
+		}
+		samples += len(*packets)
+	}
+	if samples != count {
+		t.Errorf("Expected %d samples to be received, got %d", count, samples)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Test each worker's throughput is reported
+	vars := fetchExpvar(t, apiConfig.Bind)
+	workers := vars["coco"].(map[string]interface{})["workers"].(map[string]interface{})
+	throughput := vars["coco"].(map[string]interface{})["throughput"].(map[string]interface{})
+	for name := range workers {
+		if _, ok := throughput[name]; !ok {
+			t.Errorf("Expected throughput of %s to be reported, got %+v", name, throughput)
+		}
+	}
+	// Other tests run Send workers too, so only the last 3 are ours
+	var send []string
+	for name := range workers {
+		if strings.HasPrefix(name, "send.") {
+			send = append(send, name)
+		}
+	}
+	total := 0.0
+	for i := len(send) - 3; i < len(send); i++ {
+		total += workers["send."+strconv.Itoa(i)].(float64)
+	}
+	if len(send) < 3 || total != float64(count) {
+		t.Errorf("Expected 3 send workers to process %d samples, got %+v", count, workers)
+	}
+}
+
+func TestDownsampling(t *testing.T) {
+	// Setup targets, one for a tier that averages gauges, one for a tier that
+	// forwards the last gauge
+	var listeners []*net.UDPConn
+	for _, target := range []string{"127.0.0.1:25862", "127.0.0.1:25863"} {
+		laddr, err := net.ResolveUDPAddr("udp", target)
+		if err != nil {
+			t.Fatal("Couldn't resolve address", err)
+		}
+		listener, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Fatalf("Couldn't listen to %s: %s", target, err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+
+	// Setup sender
+	interval := coco.Duration{Duration: 200 * time.Millisecond}
+	tiers := []coco.Tier{
+		coco.Tier{
+			Name:       "average",
+			Targets:    []string{"127.0.0.1:25862"},
+			Downsample: coco.DownsampleConfig{MinInterval: interval},
+		},
+		coco.Tier{
+			Name:       "last",
+			Targets:    []string{"127.0.0.1:25863"},
+			Downsample: coco.DownsampleConfig{MinInterval: interval, Aggregate: "last"},
+		},
+	}
+	filtered := make(chan collectd.Packet)
+	go coco.Send(&tiers, filtered)
+
+	for i := 1; i <= 5; i++ {
+		filtered <- collectd.Packet{
+			Hostname:   "foo",
+			Plugin:     "load",
+			Type:       "load",
+			IntervalHR: 10 << 30,
+			Values:     []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: float64(i)}},
+		}
+		filtered <- collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "interface",
+			Type:     "if_octets",
+			Values:   []collectd.Value{collectd.Value{Type: collectd.TypeDerive, Value: float64(i * 100)}},
+		}
+	}
+
+	// Test one sample per host/metric is forwarded per interval, with gauges
+	// aggregated and other values forwarded as the latest value
+	expected := []map[string]float64{
+		map[string]float64{"load/load": 3, "interface/if_octets": 500},
+		map[string]float64{"load/load": 5, "interface/if_octets": 500},
+	}
+	buf := make([]byte, 1452)
+	for i, listener := range listeners {
+		received := map[string]float64{}
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		for len(received) < len(expected[i]) {
+			n, err := listener.Read(buf)
+			if err != nil {
+				t.Fatalf("Expected %d samples to be received by tier %s, got %+v: %s", len(expected[i]), tiers[i].Name, received, err)
+			}
+			packets, err := collectd.Packets(buf[0:n], nil)
+			if err != nil {
+				t.Fatalf("Couldn't decode datagram: %s", err)
+			}
+			for _, p := range *packets {
+				name := coco.MetricName(p)
+				if _, ok := received[name]; ok {
+					t.Errorf("Expected one %s sample to be forwarded by tier %s, got more", name, tiers[i].Name)
+				}
+				received[name] = p.Values[0].Value
+				if p.Plugin == "load" && p.IntervalHR != uint64(interval.Seconds()*(1<<30)) {
+					t.Errorf("Expected interval to be the downsampling interval, got %d", p.IntervalHR)
+				}
+			}
+		}
+		if !reflect.DeepEqual(received, expected[i]) {
+			t.Errorf("Expected tier %s to forward %+v, got %+v", tiers[i].Name, expected[i], received)
+		}
+	}
+
+	// Test nothing more is forwarded when no samples arrive
+	listeners[0].SetReadDeadline(time.Now().Add(2 * interval.Duration))
+	if n, err := listeners[0].Read(buf); err == nil {
+		t.Errorf("Expected nothing to be forwarded without new samples, got %d bytes", n)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	// Test invalid rules are rejected
+	invalid := [][]coco.AggregateConfig{
+		[]coco.AggregateConfig{coco.AggregateConfig{Host: "^web-"}},
+		[]coco.AggregateConfig{coco.AggregateConfig{Hostname: "web"}},
+		[]coco.AggregateConfig{coco.AggregateConfig{Hostname: "web", Host: "(web"}},
+		[]coco.AggregateConfig{coco.AggregateConfig{Hostname: "web", Host: "^web-", Plugin: "(load"}},
+		[]coco.AggregateConfig{coco.AggregateConfig{Hostname: "web", Host: "^web-", Function: "max"}},
+	}
+	for _, configs := range invalid {
+		if _, err := coco.NewAggregator(configs); err == nil {
+			t.Errorf("Expected rule %+v to be invalid", configs[0])
+		}
+	}
+
+	// Setup aggregator
+	interval := coco.Duration{Duration: 200 * time.Millisecond}
+	aggregator, err := coco.NewAggregator([]coco.AggregateConfig{
+		coco.AggregateConfig{Hostname: "web", Host: "^web-", Plugin: "^load$", TickInterval: interval},
+		coco.AggregateConfig{Hostname: "web-average", Host: "^web-[0-9]+$", Plugin: "^load$", Function: "average", TickInterval: interval},
+		coco.AggregateConfig{Hostname: "web-requests", Host: "^web-[0-9]+$", Plugin: "^nginx$", TickInterval: interval},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't setup aggregator: %s", err)
+	}
+
+	// Setup filter
+	config := coco.FilterConfig{Blacklist: "/users$", Aggregator: aggregator}
+	raw := make(chan collectd.Packet)
+	filtered := make(chan collectd.Packet, 100)
+	items := make(chan coco.BlacklistItem, 100)
+	go coco.Filter(config, raw, filtered, items)
+	go coco.Aggregate(aggregator, coco.QueueConfig{}, filtered)
+
+	samples := []collectd.Packet{
+		collectd.Packet{Hostname: "web-1", Plugin: "load", Type: "load", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 5}}},
+		// Only the latest sample from a host counts
+		collectd.Packet{Hostname: "web-1", Plugin: "load", Type: "load", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 1}}},
+		collectd.Packet{Hostname: "web-2", Plugin: "load", Type: "load", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 3}}},
+		// Other hosts and plugins aren't aggregated
+		collectd.Packet{Hostname: "db-1", Plugin: "load", Type: "load", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 100}}},
+		collectd.Packet{Hostname: "web-1", Plugin: "memory", Type: "memory", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 100}}},
+		// Blacklisted samples aren't aggregated
+		collectd.Packet{Hostname: "web-3", Plugin: "load", Type: "users", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: 100}}},
+		// Metrics without values to combine aren't emitted
+		collectd.Packet{Hostname: "web-1", Plugin: "load", Type: "idle", Values: []collectd.Value{collectd.Value{Type: collectd.TypeGauge, Value: math.NaN()}}},
+	}
+	for _, p := range samples {
+		raw <- p
+	}
+
+	// Test accepted samples are passed through, and the rolled up samples
+	// are emitted once per interval
+	expected := map[string]float64{"web": 4, "web-average": 2}
+	received := map[string]float64{}
+	timeout := time.After(time.Second)
+	for len(received) < len(expected) {
+		select {
+		case p := <-filtered:
+			if _, ok := expected[p.Hostname]; !ok {
+				continue
+			}
+			if _, ok := received[p.Hostname]; ok {
+				t.Errorf("Expected one sample from %s, got more", p.Hostname)
+			}
+			if coco.MetricName(p) != "load/load" {
+				t.Errorf("Expected aggregated sample to keep its metric name, got %s", coco.MetricName(p))
+			}
+			received[p.Hostname] = p.Values[0].Value
+		case <-timeout:
+			t.Fatalf("Expected aggregated samples %+v, got %+v", expected, received)
+		}
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected aggregated samples %+v, got %+v", expected, received)
+	}
+
+	// Test hosts are still rolled up in the intervals after their samples
+	// arrive, until their samples are stale
+	rounds := 1
+	deadline := time.After(10 * interval.Duration)
+stale:
+	for {
+		select {
+		case p := <-filtered:
+			v, ok := expected[p.Hostname]
+			if !ok {
+				continue
+			}
+			if coco.MetricName(p) != "load/load" || p.Values[0].Value != v {
+				t.Errorf("Expected %s to be rolled up to %f, got %+v", p.Hostname, v, p)
+			}
+			if p.Hostname == "web" {
+				rounds += 1
+			}
+		case <-time.After(2 * interval.Duration):
+			break stale
+		case <-deadline:
+			t.Fatalf("Expected nothing to be emitted once samples are stale, got %d rounds", rounds)
+		}
+	}
+	if rounds < 2 {
+		t.Errorf("Expected hosts to be rolled up in later intervals, got %d rounds", rounds)
+	}
+	empty := expvar.Get("coco.aggregate").(*expvar.Map).Get("empty").(*expvar.Int)
+	if empty.Value() == 0 {
+		t.Errorf("Expected metrics without values to be counted as empty")
+	}
+
+	// Test counters are rolled up from how much they've increased, into a
+	// total that never goes down
+	requests := func(host string, value float64) {
+		raw <- collectd.Packet{Hostname: host, Plugin: "nginx", Type: "requests", Values: []collectd.Value{collectd.Value{Type: collectd.TypeCounter, Value: value}}}
+	}
+	total := 0.0
+	waitForTotal := func(expected float64) {
+		timeout := time.After(10 * interval.Duration)
+		for total != expected {
+			select {
+			case p := <-filtered:
+				if p.Hostname != "web-requests" {
+					continue
+				}
+				v := p.Values[0]
+				if v.Type != collectd.TypeDerive {
+					t.Errorf("Expected rolled up counter to be a derive, got %+v", v)
+				}
+				if v.Value < total || v.Value > expected {
+					t.Fatalf("Expected rolled up counter to grow from %f to %f, got %f", total, expected, v.Value)
+				}
+				total = v.Value
+			case <-timeout:
+				t.Fatalf("Expected rolled up counter to reach %f, got %f", expected, total)
+			}
+		}
+	}
+
+	// The first samples from each host are baselines
+	requests("web-1", 1000)
+	requests("web-2", 5000)
+	requests("web-1", 1010)
+	requests("web-2", 5020)
+	waitForTotal(30)
+
+	// A host joining doesn't add its whole count, and a host that restarts
+	// starts again from its new count
+	requests("web-3", 1000000)
+	requests("web-3", 1000005)
+	requests("web-1", 2)
+	requests("web-1", 7)
+	waitForTotal(40)
+
+	// A host that went stale starts again from its new count when it returns
+	requests("web-3", 1000010)
+	waitForTotal(45)
+	// Keep web-1 reporting while the others go stale after 3 intervals
+	for i := 0; i < 5; i++ {
+		requests("web-1", 7)
+		time.Sleep(interval.Duration)
+	}
+	requests("web-2", 9000)
+	requests("web-2", 9005)
+	requests("web-3", 1000015)
+	waitForTotal(50)
+}
+
+// Test samples survive being encoded and decoded by gollectd
+func assertRoundTrip(t *testing.T, packet collectd.Packet) {
+	payload, err := coco.Encode(packet)
+	if err != nil {
+		t.Fatalf("Couldn't encode %+v: %s", packet, err)
+	}
+	decoded, err := collectd.Packets(payload, nil)
+	if err != nil {
+		t.Fatalf("Couldn't decode %x: %s", payload, err)
+	}
+	if len(*decoded) != 1 {
+		t.Fatalf("Expected 1 sample to be decoded, got %d", len(*decoded))
+	}
+	p := (*decoded)[0]
+	if p.Hostname != packet.Hostname || p.Plugin != packet.Plugin || p.PluginInstance != packet.PluginInstance || p.Type != packet.Type || p.TypeInstance != packet.TypeInstance {
+		t.Fatalf("Expected identifier to survive encoding, got %s", p.FormatName())
+	}
+	if p.Time != packet.Time || p.TimeHR != packet.TimeHR || p.Interval != packet.Interval || p.IntervalHR != packet.IntervalHR {
+		t.Fatalf("Expected times to survive encoding, got %+v", p)
+	}
+	if len(p.Values) != len(packet.Values) {
+		t.Fatalf("Expected %d values, got %d", len(packet.Values), len(p.Values))
+	}
+	for i, v := range packet.Values {
+		got := p.Values[i]
+		// Compare bits, so NaN gauges match
+		if got.Type != v.Type || math.Float64bits(got.Value) != math.Float64bits(v.Value) {
+			t.Fatalf("Expected value %d to be %+v, got %+v", i, v, got)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	values := []collectd.Value{
+		collectd.Value{Type: collectd.TypeGauge, Value: 1.5},
+		collectd.Value{Type: collectd.TypeGauge, Value: math.NaN()},
+		collectd.Value{Type: collectd.TypeCounter, Value: 1 << 40},
+		collectd.Value{Type: collectd.TypeDerive, Value: -42},
+		collectd.Value{Type: collectd.TypeAbsolute, Value: 7},
+	}
+	packets := []collectd.Packet{
+		// Every field set
+		collectd.Packet{
+			Hostname:       "foo",
+			Plugin:         "interface",
+			PluginInstance: "eth0",
+			Type:           "if_octets",
+			TypeInstance:   "rx",
+			Time:           1438000000,
+			Interval:       10,
+			Values:         values,
+		},
+		// High resolution times
+		collectd.Packet{
+			Hostname:   "foo",
+			Plugin:     "load",
+			Type:       "load",
+			TimeHR:     1438000000 << 30,
+			IntervalHR: 10 << 30,
+			Values:     values[:1],
+		},
+		// Strings longer than a single byte length can describe
+		collectd.Packet{
+			Hostname:       strings.Repeat("h", 300),
+			Plugin:         strings.Repeat("p", 300),
+			PluginInstance: strings.Repeat("i", 300),
+			Type:           strings.Repeat("t", 300),
+			TypeInstance:   strings.Repeat("x", 300),
+			Values:         values,
+		},
+		// More values than a single byte count can describe
+		collectd.Packet{
+			Hostname: "foo",
+			Plugin:   "bar",
+			Type:     "baz",
+			Values:   make([]collectd.Value, 1000),
+		},
+	}
+	for _, packet := range packets {
+		assertRoundTrip(t, packet)
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	gauge := collectd.Value{Type: collectd.TypeGauge, Value: 1.0}
+	packets := map[string]collectd.Packet{
+		"long host":       collectd.Packet{Hostname: strings.Repeat("h", 65535), Plugin: "load", Type: "load"},
+		"null byte":       collectd.Packet{Hostname: "foo\x00bar", Plugin: "load", Type: "load"},
+		"too many values": collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load", Values: make([]collectd.Value, 10000)},
+		"unknown type":    collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load", Values: []collectd.Value{gauge, collectd.Value{Type: 9}}},
+		"negative counter": collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load", Values: []collectd.Value{
+			collectd.Value{Type: collectd.TypeCounter, Value: -1},
+		}},
+		"NaN derive": collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load", Values: []collectd.Value{
+			collectd.Value{Type: collectd.TypeDerive, Value: math.NaN()},
+		}},
+		"overflowing absolute": collectd.Packet{Hostname: "foo", Plugin: "load", Type: "load", Values: []collectd.Value{
+			collectd.Value{Type: collectd.TypeAbsolute, Value: math.Exp2(64)},
+		}},
+	}
+	for name, packet := range packets {
+		if _, err := coco.Encode(packet); err == nil {
+			t.Errorf("Expected %s to fail to encode", name)
+		}
+	}
+}
+
+func FuzzEncode(f *testing.F) {
+	f.Add("foo", "load", "", "load", "", uint64(1438000000), []byte{1, 1, 1}, make([]byte, 24))
+	f.Add("foo", "interface", "eth0", "if_octets", "rx", uint64(0), []byte{0, 2, 3}, bytes.Repeat([]byte{0xff}, 24))
+	f.Add(strings.Repeat("h", 300), "p", "", "t", "", uint64(1), []byte{4}, make([]byte, 8))
+	f.Fuzz(func(t *testing.T, host, plugin, pluginInstance, typ, typeInstance string, time uint64, kinds []byte, raw []byte) {
+		packet := collectd.Packet{
+			Hostname:       host,
+			Plugin:         plugin,
+			PluginInstance: pluginInstance,
+			Type:           typ,
+			TypeInstance:   typeInstance,
+			TimeHR:         time,
+		}
+		for i, kind := range kinds {
+			if len(raw) < 8*(i+1) {
+				break
+			}
+			bits := binary.BigEndian.Uint64(raw[8*i:])
+			v := collectd.Value{Type: kind}
+			switch kind {
+			case collectd.TypeGauge:
+				v.Value = math.Float64frombits(bits)
+			case collectd.TypeDerive:
+				v.Value = float64(int64(bits))
+			default:
+				v.Value = float64(bits)
+			}
+			packet.Values = append(packet.Values, v)
+		}
+
+		// Anything that encodes must decode to the same sample
+		if _, err := coco.Encode(packet); err != nil {
+			return
+		}
+		assertRoundTrip(t, packet)
+	})
+}
+
+func fetchJSON(t *testing.T, url string, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		t.Errorf("Error when decoding JSON %+v.", err)
+		t.Errorf("Response body: %s", string(body))
+		t.FailNow()
+	}
+}
+
+func encode(t *testing.T, packet collectd.Packet) []byte {
+	payload, err := coco.Encode(packet)
+	if err != nil {
+		t.Fatalf("Couldn't encode %+v: %s", packet, err)
+	}
+	return payload
+}
@@ -0,0 +1,231 @@
+package coco
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often to log a packet that couldn't be decoded
+const decodeLogInterval = 10 * time.Second
+
+// Reasons a packet couldn't be decoded
+var decodeErrors = []string{"unknown_type", "malformed", "truncated", "unsupported"}
+
+// TypesDB is the list of types.db files used to decode collectd packets. It
+// can be configured as a single path, or an array of paths.
+type TypesDB []string
+
+// UnmarshalTOML decodes either form of types.db configuration
+func (t *TypesDB) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*t = TypesDB{v}
+	case []interface{}:
+		for _, p := range v {
+			path, ok := p.(string)
+			if !ok {
+				return fmt.Errorf("typesdb must be a path or an array of paths")
+			}
+			*t = append(*t, path)
+		}
+	default:
+		return fmt.Errorf("typesdb must be a path or an array of paths")
+	}
+	return nil
+}
+
+// Load parses every types.db file, merging them. Types defined in later files
+// replace those defined in earlier ones, like collectd.
+func (t TypesDB) Load() (collectd.Types, error) {
+	if len(t) == 0 {
+		return nil, fmt.Errorf("no types.db configured")
+	}
+	types := collectd.Types{}
+	for _, path := range t {
+		parsed, err := collectd.TypesDBFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		for k, v := range parsed {
+			types[k] = v
+		}
+	}
+	return types, nil
+}
+
+var (
+	// Samples whose type isn't in types.db, by type
+	unknownTypes = expvar.NewMap("coco.unknown_types")
+	// Decoders that reload their types.db on ReloadTypesDB
+	decodersLock sync.Mutex
+	decoders     []*decoder
+)
+
+// ReloadTypesDB reloads the types.db files of every collectd listener. If any
+// file can't be parsed, the listener carries on with the types it has.
+func ReloadTypesDB() {
+	decodersLock.Lock()
+	defer decodersLock.Unlock()
+	for _, d := range decoders {
+		d.reload()
+	}
+}
+
+// decoder decodes collectd packets, counting, logging, and optionally
+// capturing those that can't be decoded.
+type decoder struct {
+	paths     TypesDB
+	typesLock sync.RWMutex
+	types     collectd.Types
+
+	lock sync.Mutex
+	// when the last bad packet was logged, and how many haven't been since
+	logged     time.Time
+	suppressed int
+	// where bad packets are captured to, and how much has been captured
+	capture  *os.File
+	captured int64
+	limit    int64
+}
+
+// newDecoder sets up a decoder, opening the capture file if one is configured.
+// If types are given, the decoder reloads them from the listener's types.db
+// files on ReloadTypesDB.
+func newDecoder(config ListenConfig, types collectd.Types) (*decoder, error) {
+	for _, reason := range decodeErrors {
+		errorCounts.Add("listen.decode."+reason, 0)
+	}
+	errorCounts.Add("listen.capture", 0)
+	errorCounts.Add("listen.typesdb", 0)
+
+	d := &decoder{types: types, limit: config.CaptureLimit()}
+	if types != nil {
+		d.paths = config.Typesdb
+		decodersLock.Lock()
+		decoders = append(decoders, d)
+		decodersLock.Unlock()
+	}
+	if len(config.Capture) > 0 {
+		file, err := os.OpenFile(config.Capture, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		d.capture, d.captured = file, info.Size()
+	}
+	return d, nil
+}
+
+// decode breaks a packet into samples. Samples are only returned if the
+// whole packet could be decoded.
+func (d *decoder) decode(payload []byte, source string) []collectd.Packet {
+	d.typesLock.RLock()
+	types := d.types
+	d.typesLock.RUnlock()
+
+	packets, err := parse(payload, types)
+	if err == nil {
+		// Samples with types missing from types.db are decoded without
+		// names for their values, which routing doesn't need.
+		for _, p := range packets {
+			if _, ok := types[p.Type]; types != nil && !ok {
+				unknownTypes.Add(p.Type, 1)
+			}
+		}
+		return packets
+	}
+
+	reason := "malformed"
+	switch err {
+	case collectd.ErrorUnsupported:
+		reason = "unsupported"
+	case io.EOF, io.ErrUnexpectedEOF:
+		reason = "truncated"
+	case errTypesMismatch:
+		reason = "unknown_type"
+	}
+	errorCounts.Add("listen.decode."+reason, 1)
+	d.report(payload, source, reason, err)
+	return nil
+}
+
+// reload replaces the decoder's types with those in its types.db files
+func (d *decoder) reload() {
+	types, err := d.paths.Load()
+	if err != nil {
+		log.Printf("[error] Listen: failed to reload types.db, keeping the types already loaded: %s", err)
+		errorCounts.Add("listen.typesdb", 1)
+		return
+	}
+	d.typesLock.Lock()
+	d.types = types
+	d.typesLock.Unlock()
+	log.Printf("[info] Listen: reloaded %d types from %s", len(types), strings.Join(d.paths, ", "))
+}
+
+var errTypesMismatch = errors.New("values don't match data sources in types.db")
+
+// parse wraps collectd.Packets, which panics on some malformed packets
+func parse(payload []byte, types collectd.Types) (packets []collectd.Packet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			packets = nil
+			err = fmt.Errorf("%v", r)
+			// Decoding without types.db only fails if the packet is malformed
+			if types != nil {
+				if _, e := parse(payload, nil); e == nil {
+					err = errTypesMismatch
+				}
+			}
+		}
+	}()
+
+	p, err := collectd.Packets(payload, types)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return *p, nil
+}
+
+// report logs a packet that couldn't be decoded, at most once per interval,
+// and captures it if capturing is enabled.
+func (d *decoder) report(payload []byte, source string, reason string, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.logged) >= decodeLogInterval {
+		if d.suppressed > 0 {
+			log.Printf("[warning] Listen: %d more packets couldn't be decoded since the last was logged", d.suppressed)
+		}
+		log.Printf("[warning] Listen: couldn't decode packet from %s (%s): %s. Payload: %x", source, reason, err, payload)
+		d.logged, d.suppressed = now, 0
+	} else {
+		d.suppressed += 1
+	}
+
+	if d.capture == nil {
+		return
+	}
+	// One packet per line: time, source, reason, hex-encoded payload
+	record := fmt.Sprintf("%d %s %s %x\n", now.Unix(), source, reason, payload)
+	if d.captured+int64(len(record)) > d.limit {
+		return
+	}
+	if _, err := d.capture.WriteString(record); err != nil {
+		errorCounts.Add("listen.capture", 1)
+		return
+	}
+	d.captured += int64(len(record))
+}
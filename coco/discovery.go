@@ -0,0 +1,212 @@
+package coco
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Page describes the slice of results returned by a discovery endpoint
+type Page struct {
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// HostSummary describes a host Coco has routed metrics for
+type HostSummary struct {
+	Host     string            `json:"host"`
+	Metrics  int               `json:"metrics"`
+	LastSeen int64             `json:"last_seen"`
+	Targets  map[string]string `json:"targets"`
+}
+
+// MetricSummary describes a metric Coco has routed for a host
+type MetricSummary struct {
+	Host     string `json:"host,omitempty"`
+	Name     string `json:"metric"`
+	LastSeen int64  `json:"last_seen"`
+}
+
+type HostsJSON struct {
+	Page
+	Hosts []HostSummary `json:"hosts"`
+}
+
+type MetricsJSON struct {
+	Page
+	Host    string          `json:"host,omitempty"`
+	Metrics []MetricSummary `json:"metrics"`
+}
+
+func errorResponse(code int, err error) (int, []byte) {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return code, data
+}
+
+// paginate determines the page requested with the offset and limit parameters
+func paginate(req *http.Request, total int) (Page, error) {
+	page := Page{Total: total, Limit: defaultPageLimit}
+	qs := req.URL.Query()
+	if v := qs.Get("offset"); len(v) > 0 {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return page, fmt.Errorf("invalid offset '%s'", v)
+		}
+		page.Offset = offset
+	}
+	if v := qs.Get("limit"); len(v) > 0 {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("invalid limit '%s', must be between 1 and %d", v, maxPageLimit)
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+// bounds determines the indexes of the results on the page
+func (p Page) bounds() (int, int) {
+	start := p.Offset
+	if start > p.Total {
+		start = p.Total
+	}
+	end := start + p.Limit
+	if end > p.Total {
+		end = p.Total
+	}
+	return start, end
+}
+
+// routes merges the Mappings of all tiers into host -> metric -> last seen,
+// and host -> tier -> target.
+func routes(tiers *[]Tier) (map[string]map[string]int64, map[string]map[string]string) {
+	routesLock.RLock()
+	defer routesLock.RUnlock()
+
+	seen := map[string]map[string]int64{}
+	targets := map[string]map[string]string{}
+	for _, tier := range *tiers {
+		for target, hosts := range tier.Mappings {
+			for host, metrics := range hosts {
+				if seen[host] == nil {
+					seen[host] = map[string]int64{}
+					targets[host] = map[string]string{}
+				}
+				targets[host][tier.Name] = target
+				for name, ts := range metrics {
+					if ts > seen[host][name] {
+						seen[host][name] = ts
+					}
+				}
+			}
+		}
+	}
+	return seen, targets
+}
+
+// Hosts lists all hosts Coco has routed metrics for
+func Hosts(req *http.Request, tiers *[]Tier) (int, []byte) {
+	seen, targets := routes(tiers)
+
+	names := []string{}
+	for host := range seen {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	page, err := paginate(req, len(names))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+	start, end := page.bounds()
+
+	result := HostsJSON{Page: page, Hosts: []HostSummary{}}
+	for _, host := range names[start:end] {
+		summary := HostSummary{Host: host, Metrics: len(seen[host]), Targets: targets[host]}
+		for _, ts := range seen[host] {
+			if ts > summary.LastSeen {
+				summary.LastSeen = ts
+			}
+		}
+		result.Hosts = append(result.Hosts, summary)
+	}
+
+	data, _ := json.Marshal(result)
+	return http.StatusOK, data
+}
+
+// HostMetrics lists all metrics Coco has routed for a host
+func HostMetrics(host string, req *http.Request, tiers *[]Tier) (int, []byte) {
+	seen, _ := routes(tiers)
+	if seen[host] == nil {
+		return errorResponse(http.StatusNotFound, fmt.Errorf("unknown host '%s'", host))
+	}
+
+	metrics := []MetricSummary{}
+	for name, ts := range seen[host] {
+		metrics = append(metrics, MetricSummary{Name: name, LastSeen: ts})
+	}
+	sort.Sort(byMetric(metrics))
+
+	page, err := paginate(req, len(metrics))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+	start, end := page.bounds()
+
+	data, _ := json.Marshal(MetricsJSON{Page: page, Host: host, Metrics: metrics[start:end]})
+	return http.StatusOK, data
+}
+
+// Search finds all metrics Coco has routed where "host/metric" matches the
+// regex in the q parameter, in the same way Filter matches the blacklist.
+func Search(req *http.Request, tiers *[]Tier) (int, []byte) {
+	q := req.URL.Query().Get("q")
+	if len(q) == 0 {
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("no query specified with ?q="))
+	}
+	re, err := regexp.Compile(q)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+
+	seen, _ := routes(tiers)
+	metrics := []MetricSummary{}
+	for host, names := range seen {
+		for name, ts := range names {
+			if re.MatchString(host + "/" + name) {
+				metrics = append(metrics, MetricSummary{Host: host, Name: name, LastSeen: ts})
+			}
+		}
+	}
+	sort.Sort(byMetric(metrics))
+
+	page, err := paginate(req, len(metrics))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+	start, end := page.bounds()
+
+	data, _ := json.Marshal(MetricsJSON{Page: page, Metrics: metrics[start:end]})
+	return http.StatusOK, data
+}
+
+type byMetric []MetricSummary
+
+func (m byMetric) Len() int      { return len(m) }
+func (m byMetric) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byMetric) Less(i, j int) bool {
+	if m[i].Host != m[j].Host {
+		return m[i].Host < m[j].Host
+	}
+	return m[i].Name < m[j].Name
+}
@@ -0,0 +1,179 @@
+package coco
+
+import (
+	"expvar"
+	collectd "github.com/kimor79/gollectd"
+	"math"
+	"sync"
+	"time"
+)
+
+// How values are aggregated. Downsampled tiers aggregate gauges by average or
+// last, and aggregation rules combine values across hosts by sum or average.
+const (
+	AggregateAverage = "average"
+	AggregateLast    = "last"
+	AggregateSum     = "sum"
+)
+
+// Samples merged into another sample by downsampling, per tier
+var downsampleCounts = expvar.NewMap("coco.downsampled")
+
+// DownsampleConfig describes how samples are downsampled for a tier. If
+// MinInterval is 0, every sample is forwarded. Otherwise at most one sample
+// per host/metric is forwarded per MinInterval. Gauges are aggregated by
+// Aggregate, and other values are forwarded as their latest value.
+type DownsampleConfig struct {
+	MinInterval Duration
+	Aggregate   string
+}
+
+// pending accumulates the samples for a host/metric within an interval
+type pending struct {
+	// The latest sample
+	packet collectd.Packet
+	// Sums and counts of each gauge, for averaging. NaNs aren't counted.
+	sums    []float64
+	counts  []int64
+	samples int64
+}
+
+// downsampler accumulates samples for a tier until its interval has elapsed.
+// It is locked, as every Send worker adds samples to it.
+type downsampler struct {
+	lock    sync.Mutex
+	pending map[string]*pending
+	emitted time.Time
+}
+
+// buildDownsampler sets up a downsampler for a tier, if downsampling is
+// enabled.
+func buildDownsampler(tier *Tier) {
+	if tier.Downsample.MinInterval.Duration <= 0 {
+		return
+	}
+	downsampleCounts.Add(tier.Name, 0)
+	tier.downsampler = &downsampler{pending: make(map[string]*pending), emitted: time.Now()}
+}
+
+// downsampleTick determines how often tiers are checked for downsampled
+// samples to emit. It is 0 if no tier downsamples.
+func downsampleTick(tiers *[]Tier) time.Duration {
+	var tick time.Duration
+	for _, tier := range *tiers {
+		if tier.downsampler == nil {
+			continue
+		}
+		// Check at least every second, so samples are emitted close to
+		// when their interval elapses
+		i := tier.Downsample.MinInterval.Duration
+		if i > time.Second {
+			i = time.Second
+		}
+		if tick == 0 || i < tick {
+			tick = i
+		}
+	}
+	return tick
+}
+
+// sameLayout determines if two samples have the same number and types of
+// values, so they can be aggregated
+func sameLayout(a collectd.Packet, b collectd.Packet) bool {
+	if len(a.Values) != len(b.Values) {
+		return false
+	}
+	for i, v := range a.Values {
+		if v.Type != b.Values[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+// downsample merges a sample into the pending sample for its host/metric
+func (t *Tier) downsample(packet collectd.Packet) {
+	d := t.downsampler
+	key := packet.Hostname + "/" + MetricName(packet)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p := d.pending[key]
+	if p != nil && !sameLayout(p.packet, packet) {
+		// The type has changed, e.g. after types.db was reloaded, so start
+		// again with the new sample
+		downsampleCounts.Add(t.Name, p.samples)
+		p = nil
+	}
+	if p == nil {
+		p = &pending{
+			sums:   make([]float64, len(packet.Values)),
+			counts: make([]int64, len(packet.Values)),
+		}
+		d.pending[key] = p
+	}
+	p.packet = packet
+	p.samples += 1
+	for i, v := range packet.Values {
+		if v.Type == collectd.TypeGauge && !math.IsNaN(v.Value) {
+			p.sums[i] += v.Value
+			p.counts[i] += 1
+		}
+	}
+}
+
+// emitDownsampled routes one sample per host/metric accumulated by a tier,
+// once the tier's interval has elapsed since it last did
+func (t *Tier) emitDownsampled(now time.Time) {
+	d := t.downsampler
+	if d == nil {
+		return
+	}
+	interval := t.Downsample.MinInterval.Duration
+
+	d.lock.Lock()
+	if now.Sub(d.emitted) < interval {
+		d.lock.Unlock()
+		return
+	}
+	d.emitted = now
+	accumulated := d.pending
+	d.pending = make(map[string]*pending)
+	d.lock.Unlock()
+
+	for _, p := range accumulated {
+		packet := t.aggregate(p, interval)
+		downsampleCounts.Add(t.Name, p.samples-1)
+		payload, err := Encode(packet)
+		if err != nil {
+			errorCounts.Add("send.encode", 1)
+			continue
+		}
+		t.route(packet, payload)
+	}
+}
+
+// aggregate builds the sample forwarded for a host/metric's pending samples
+func (t *Tier) aggregate(p *pending, interval time.Duration) collectd.Packet {
+	packet := p.packet
+	// The values are copied, because every tier is sent the same sample
+	packet.Values = make([]collectd.Value, len(p.packet.Values))
+	copy(packet.Values, p.packet.Values)
+	if t.Downsample.Aggregate != AggregateLast {
+		for i, v := range packet.Values {
+			if v.Type == collectd.TypeGauge && p.counts[i] > 0 {
+				packet.Values[i].Value = p.sums[i] / float64(p.counts[i])
+			}
+		}
+	}
+
+	// Tell the target how often to expect samples, so it doesn't treat the
+	// gaps between them as missing data
+	if packet.Interval > 0 {
+		packet.Interval = uint64(interval.Seconds())
+	}
+	if packet.IntervalHR > 0 {
+		packet.IntervalHR = uint64(interval.Seconds() * (1 << 30))
+	}
+	return packet
+}
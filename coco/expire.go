@@ -0,0 +1,166 @@
+package coco
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const defaultStaleAfter = 5 * time.Minute
+
+// StaleJSON lists hosts that have stopped reporting entirely, and metrics that
+// have stopped reporting on hosts that are otherwise still reporting.
+type StaleJSON struct {
+	Hosts   []HostSummary   `json:"hosts"`
+	Metrics []MetricSummary `json:"metrics"`
+}
+
+// expireRoutes removes all hosts and metrics from the tiers' Mappings that
+// haven't been seen since the cutoff, and updates the hash counters.
+func expireRoutes(tiers *[]Tier, cutoff int64) {
+	routesLock.Lock()
+	defer routesLock.Unlock()
+
+	for _, tier := range *tiers {
+		for target, hosts := range tier.Mappings {
+			for host, metrics := range hosts {
+				for name, ts := range metrics {
+					if ts < cutoff {
+						delete(metrics, name)
+						expireCounts.Add("metrics", 1)
+					}
+				}
+				if len(metrics) == 0 {
+					delete(hosts, host)
+					expireCounts.Add("hosts", 1)
+				}
+			}
+
+			// Update counters, as Send only counts new routes
+			countRoutes(target, hosts)
+		}
+	}
+}
+
+// expireBlacklisted removes all blacklisted metrics that haven't been seen
+// since the cutoff.
+func expireBlacklisted(blacklisted *map[string]map[string]int64, cutoff int64) {
+	blacklistLock.Lock()
+	defer blacklistLock.Unlock()
+
+	for host, metrics := range *blacklisted {
+		for name, ts := range metrics {
+			if ts < cutoff {
+				delete(metrics, name)
+				expireCounts.Add("blacklisted", 1)
+			}
+		}
+		if len(metrics) == 0 {
+			delete(*blacklisted, host)
+		}
+	}
+}
+
+// Expire periodically removes routes and blacklisted metrics that haven't been
+// seen within the TTL, so decommissioned hosts don't stay around forever.
+func Expire(config ExpireConfig, tiers *[]Tier, blacklisted *map[string]map[string]int64) {
+	// Initialise the counts
+	expireCounts.Add("metrics", 0)
+	expireCounts.Add("hosts", 0)
+	expireCounts.Add("blacklisted", 0)
+
+	if config.TTL.Duration == 0 {
+		log.Println("[info] Expire: no ttl configured, routes and blacklisted metrics will never expire")
+		return
+	}
+	log.Printf("[info] Expire: expiring routes and blacklisted metrics not seen for %s", config.TTL.Duration)
+
+	tick := time.NewTicker(config.Interval()).C
+	for {
+		select {
+		case <-tick:
+			cutoff := time.Now().Add(-config.TTL.Duration).Unix()
+			expireRoutes(tiers, cutoff)
+			expireBlacklisted(blacklisted, cutoff)
+		}
+	}
+}
+
+// parseDurationParam parses a duration from a query string parameter, falling
+// back to a default if the parameter isn't set.
+func parseDurationParam(req *http.Request, name string, fallback time.Duration) (time.Duration, error) {
+	v := req.URL.Query().Get(name)
+	if len(v) == 0 {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", name, v)
+	}
+	return d, nil
+}
+
+// Stale finds hosts and metrics that haven't been seen for the duration in
+// the after parameter (default 5m). If the within parameter is set, only
+// hosts and metrics last seen within that duration are included, so
+// long-dead hosts don't drown out recent failures.
+func Stale(req *http.Request, tiers *[]Tier) (int, []byte) {
+	after, err := parseDurationParam(req, "after", defaultStaleAfter)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+	within, err := parseDurationParam(req, "within", 0)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err)
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-after).Unix()
+	var oldest int64
+	if within > 0 {
+		oldest = now.Add(-within).Unix()
+	}
+
+	seen, targets := routes(tiers)
+	result := StaleJSON{Hosts: []HostSummary{}, Metrics: []MetricSummary{}}
+	for host, metrics := range seen {
+		var last int64
+		stale := []MetricSummary{}
+		for name, ts := range metrics {
+			if ts > last {
+				last = ts
+			}
+			if ts < cutoff && ts >= oldest {
+				stale = append(stale, MetricSummary{Host: host, Name: name, LastSeen: ts})
+			}
+		}
+
+		if last < cutoff {
+			// The whole host has stopped reporting
+			if last >= oldest {
+				result.Hosts = append(result.Hosts, HostSummary{Host: host, Metrics: len(metrics), LastSeen: last, Targets: targets[host]})
+			}
+		} else {
+			result.Metrics = append(result.Metrics, stale...)
+		}
+	}
+	sort.Sort(byHost(result.Hosts))
+	sort.Sort(byMetric(result.Metrics))
+
+	data, _ := json.Marshal(result)
+	return http.StatusOK, data
+}
+
+type byHost []HostSummary
+
+func (h byHost) Len() int           { return len(h) }
+func (h byHost) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h byHost) Less(i, j int) bool { return h[i].Host < h[j].Host }
+
+var (
+	expireCounts = expvar.NewMap("coco.expire")
+)
@@ -0,0 +1,338 @@
+package coco
+
+import (
+	"bufio"
+	"fmt"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocols for Graphite plaintext and StatsD input
+const (
+	ProtocolGraphite    = "graphite"
+	ProtocolGraphiteUDP = "graphite-udp"
+	ProtocolStatsd      = "statsd"
+)
+
+// The template used if a Graphite or StatsD listener doesn't define any
+const defaultTemplate = "host.plugin.type_instance*"
+
+// Unescapes hostnames in Graphite paths, the reverse of how Noodle exposes
+// hosts to Graphite clients: _ is a dot, and __ is an underscore. Replacers
+// match from left to right, so __ is unescaped before _.
+var graphiteHostUnescaper = strings.NewReplacer("__", "_", "_", ".")
+
+/*
+Template maps the components of a Graphite path onto sample identifier
+fields. Templates are written as an optional filter followed by the fields,
+separated by a space:
+
+	servers.* _.host.plugin.type_instance*
+
+The filter is matched against the leading components of the path, with shell
+patterns. Each field is one of host, plugin, plugin_instance, type, or
+type_instance, or empty or _ to skip the component. A field may appear more
+than once, in which case the components are joined with _. If the last field
+ends in *, it consumes the rest of the path.
+
+Hosts have _ replaced with ., the reverse of how Noodle exposes hosts in
+Graphite paths.
+*/
+type Template struct {
+	filter []string
+	fields []string
+	greedy bool
+}
+
+// ParseTemplate parses a template in the format described on Template
+func ParseTemplate(s string) (Template, error) {
+	var t Template
+	parts := strings.Fields(s)
+	switch len(parts) {
+	case 1:
+	case 2:
+		t.filter = strings.Split(parts[0], ".")
+		for _, p := range t.filter {
+			if _, err := path.Match(p, ""); err != nil {
+				return t, fmt.Errorf("invalid filter in template '%s'", s)
+			}
+		}
+	default:
+		return t, fmt.Errorf("invalid template '%s'", s)
+	}
+
+	t.fields = strings.Split(parts[len(parts)-1], ".")
+	last := len(t.fields) - 1
+	if strings.HasSuffix(t.fields[last], "*") {
+		t.fields[last] = strings.TrimSuffix(t.fields[last], "*")
+		t.greedy = true
+	}
+	plugin := false
+	for _, f := range t.fields {
+		if f == "plugin" {
+			plugin = true
+		}
+		if _, ok := tagFields[f]; !ok && f != "" && f != "_" {
+			return t, fmt.Errorf("unknown field '%s' in template '%s'", f, s)
+		}
+	}
+	if !plugin {
+		return t, fmt.Errorf("template '%s' doesn't set plugin", s)
+	}
+	return t, nil
+}
+
+// parseTemplates parses a listener's templates, falling back to the default
+func parseTemplates(ss []string) ([]Template, error) {
+	if len(ss) == 0 {
+		ss = []string{defaultTemplate}
+	}
+	var templates []Template
+	for _, s := range ss {
+		t, err := ParseTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// Match determines if a template can be applied to the components of a path
+func (t Template) Match(components []string) bool {
+	if len(components) < len(t.fields) || (!t.greedy && len(components) > len(t.fields)) {
+		return false
+	}
+	if len(t.filter) > len(components) {
+		return false
+	}
+	for i, p := range t.filter {
+		if ok, _ := path.Match(p, components[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply sets the identifier fields on a sample from the components of a path
+func (t Template) Apply(components []string, packet *collectd.Packet) {
+	values := map[string][]string{}
+	for i, f := range t.fields {
+		if f == "" || f == "_" {
+			continue
+		}
+		c := []string{components[i]}
+		if t.greedy && i == len(t.fields)-1 {
+			c = components[i:]
+		}
+		values[f] = append(values[f], c...)
+	}
+	for f, c := range values {
+		if f == "host" {
+			for i := range c {
+				c[i] = graphiteHostUnescaper.Replace(c[i])
+			}
+			*tagFields[f](packet) = strings.Join(c, ".")
+			continue
+		}
+		*tagFields[f](packet) = strings.Join(c, "_")
+	}
+}
+
+// applyTemplates sets the identifier fields on a sample using the first
+// template that matches its path
+func applyTemplates(name string, templates []Template, packet *collectd.Packet) error {
+	components := strings.Split(name, ".")
+	for _, t := range templates {
+		if t.Match(components) {
+			t.Apply(components, packet)
+			return nil
+		}
+	}
+	return fmt.Errorf("no template matches '%s'", name)
+}
+
+// parseGraphite parses a line of Graphite's plaintext protocol:
+//
+//	path value [timestamp]
+func parseGraphite(line string, templates []Template) (collectd.Packet, error) {
+	var packet collectd.Packet
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return packet, fmt.Errorf("expected 'path value timestamp', got '%s'", line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return packet, fmt.Errorf("invalid value '%s'", fields[1])
+	}
+
+	packet.Time = uint64(time.Now().Unix())
+	if len(fields) == 3 {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return packet, fmt.Errorf("invalid timestamp '%s'", fields[2])
+		}
+		// Graphite uses -1 to mean now
+		if ts > 0 {
+			packet.Time = uint64(ts)
+		}
+	}
+
+	packet.Type = "gauge"
+	if err := applyTemplates(fields[0], templates, &packet); err != nil {
+		return packet, err
+	}
+	packet.Values = []collectd.Value{
+		collectd.Value{Name: "value", Type: collectd.TypeGauge, TypeName: "gauge", Value: value},
+	}
+	return packet, nil
+}
+
+// parseStatsd parses a line of StatsD's protocol:
+//
+//	name:value|type[|@rate]
+//
+// Gauges become gauge samples, counters become absolute samples (scaled by
+// the sample rate), and timers become latency samples. Relative gauges and
+// sets aren't supported, as they need state Coco doesn't keep.
+func parseStatsd(line string, templates []Template) (collectd.Packet, error) {
+	var packet collectd.Packet
+	i := strings.LastIndex(line, ":")
+	if i < 1 {
+		return packet, fmt.Errorf("expected 'name:value|type', got '%s'", line)
+	}
+	name, rest := line[:i], strings.Split(line[i+1:], "|")
+	if len(rest) < 2 || len(rest) > 3 {
+		return packet, fmt.Errorf("expected 'name:value|type', got '%s'", line)
+	}
+	if strings.HasPrefix(rest[0], "+") || (strings.HasPrefix(rest[0], "-") && rest[1] == "g") {
+		return packet, fmt.Errorf("relative gauges aren't supported")
+	}
+	value, err := strconv.ParseFloat(rest[0], 64)
+	if err != nil {
+		return packet, fmt.Errorf("invalid value '%s'", rest[0])
+	}
+
+	v := collectd.Value{Name: "value"}
+	switch rest[1] {
+	case "g":
+		packet.Type, v.Type = "gauge", collectd.TypeGauge
+	case "c":
+		rate := 1.0
+		if len(rest) == 3 {
+			rate, err = strconv.ParseFloat(strings.TrimPrefix(rest[2], "@"), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return packet, fmt.Errorf("invalid sample rate '%s'", rest[2])
+			}
+		}
+		packet.Type, v.Type = "absolute", collectd.TypeAbsolute
+		value = math.Floor(value/rate + 0.5)
+		if value < 0 {
+			return packet, fmt.Errorf("negative counters aren't supported")
+		}
+	case "ms", "h":
+		packet.Type, v.Type = "latency", collectd.TypeGauge
+	default:
+		return packet, fmt.Errorf("unsupported type '%s'", rest[1])
+	}
+	v.TypeName = collectd.ValueTypeValues[v.Type]
+	v.Value = value
+
+	packet.Time = uint64(time.Now().Unix())
+	if err := applyTemplates(name, templates, &packet); err != nil {
+		return packet, err
+	}
+	packet.Values = []collectd.Value{v}
+	return packet, nil
+}
+
+// lineListener receives samples as lines of text
+type lineListener struct {
+	config    ListenConfig
+	templates []Template
+	parse     func(string, []Template) (collectd.Packet, error)
+	decoder   *decoder
+	c         chan collectd.Packet
+}
+
+// receive parses a line, and queues the sample for Filter
+func (l *lineListener) receive(line string, source string) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	listenCounts.Add("raw", 1)
+	packet, err := l.parse(line, l.templates)
+	if err != nil {
+		errorCounts.Add("listen.decode.malformed", 1)
+		l.decoder.report([]byte(line), source, "malformed", err)
+		return
+	}
+	accept(l.config, l.c, packet)
+}
+
+// listenLines receives Graphite or StatsD samples
+func listenLines(config ListenConfig, c chan collectd.Packet) {
+	templates, err := parseTemplates(config.Templates)
+	if err != nil {
+		log.Fatalf("[fatal] Listen: %s", err)
+	}
+	decoder, err := newDecoder(config, nil)
+	if err != nil {
+		log.Fatalln("[fatal] Listen: failed to open capture file", err)
+	}
+	l := &lineListener{config: config, templates: templates, parse: parseGraphite, decoder: decoder, c: c}
+	if config.Protocol == ProtocolStatsd {
+		l.parse = parseStatsd
+	}
+
+	if config.Protocol == ProtocolGraphite {
+		listener, err := net.Listen("tcp", config.Bind)
+		if err != nil {
+			log.Fatalln("[fatal] Listen: failed to listen", err)
+		}
+		log.Printf("[info] Listen: listening for %s lines on %s", config.Protocol, listener.Addr())
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("[error] Listen: Failed to accept connection", err)
+				errorCounts.Add("fetch.receive", 1)
+				continue
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				source := conn.RemoteAddr().String()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					l.receive(scanner.Text(), source)
+				}
+			}(conn)
+		}
+	}
+
+	conn, _, err := listenUDP(config.Bind, false)
+	if err != nil {
+		log.Fatalln("[fatal] Listen: failed to listen", err)
+	}
+	log.Printf("[info] Listen: listening for %s lines on %s", config.Protocol, conn.LocalAddr())
+	// Lines aren't split across datagrams, so read the largest possible
+	buf := make([]byte, 65536)
+	for {
+		n, source, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Println("[error] Listen: Failed to receive packet", err)
+			errorCounts.Add("fetch.receive", 1)
+			continue
+		}
+		// Datagrams may contain many lines
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			l.receive(line, source.String())
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package coco
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	collectd "github.com/kimor79/gollectd"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Protocols Listen can receive samples with
+const (
+	ProtocolCollectd    = "collectd"
+	ProtocolCollectdTCP = "collectd-tcp"
+	ProtocolWriteHTTP   = "write_http"
+)
+
+// Listeners is the list of listeners to receive samples with. It can be
+// configured as a single [listen] table, or a [[listen]] array of tables.
+type Listeners []ListenConfig
+
+// UnmarshalTOML decodes either form of listener configuration
+func (l *Listeners) UnmarshalTOML(data interface{}) error {
+	var tables []map[string]interface{}
+	switch v := data.(type) {
+	case map[string]interface{}:
+		tables = append(tables, v)
+	case []map[string]interface{}:
+		tables = v
+	default:
+		return fmt.Errorf("listen must be a table or an array of tables")
+	}
+
+	// Round trip each table, so ListenConfig's fields are decoded the same
+	// way as everywhere else
+	for _, table := range tables {
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(table); err != nil {
+			return err
+		}
+		var config ListenConfig
+		if _, err := toml.Decode(buf.String(), &config); err != nil {
+			return err
+		}
+		*l = append(*l, config)
+	}
+	return nil
+}
+
+// tagFields maps tag names to the sample identifier fields they default
+var tagFields = map[string]func(*collectd.Packet) *string{
+	"host":            func(p *collectd.Packet) *string { return &p.Hostname },
+	"plugin":          func(p *collectd.Packet) *string { return &p.Plugin },
+	"plugin_instance": func(p *collectd.Packet) *string { return &p.PluginInstance },
+	"type":            func(p *collectd.Packet) *string { return &p.Type },
+	"type_instance":   func(p *collectd.Packet) *string { return &p.TypeInstance },
+}
+
+// accept applies a listener's default tags to a sample, and queues it for
+// Filter.
+func accept(config ListenConfig, c chan collectd.Packet, packet collectd.Packet) {
+	for k, v := range config.Tags {
+		if field := tagFields[k](&packet); len(*field) == 0 {
+			*field = v
+		}
+	}
+	listenCounts.Add("decoded", 1)
+	enqueue("raw", config.Queue, c, packet)
+}
+
+var (
+	kernelDropsLock   sync.Mutex
+	kernelDropsInodes []uint64
+	kernelDropsOnce   sync.Once
+)
+
+// watchKernelDrops adds a listener's sockets to those kernel drops are
+// reported for.
+func watchKernelDrops(inodes []uint64) {
+	kernelDropsLock.Lock()
+	kernelDropsInodes = append(kernelDropsInodes, inodes...)
+	kernelDropsLock.Unlock()
+
+	kernelDropsOnce.Do(func() {
+		listenCounts.Set("kernel_drops", expvar.Func(func() interface{} {
+			kernelDropsLock.Lock()
+			defer kernelDropsLock.Unlock()
+			return kernelDrops(kernelDropsInodes)
+		}))
+	})
+}
+
+// The order identifier parts are replayed in when decoding a stream
+var streamParts = []uint16{
+	collectd.ParseHost,
+	collectd.ParseSeverity,
+	collectd.ParseTime,
+	collectd.ParseTimeHR,
+	collectd.ParseInterval,
+	collectd.ParseIntervalHR,
+	collectd.ParsePlugin,
+	collectd.ParsePluginInstance,
+	collectd.ParseType,
+	collectd.ParseTypeInstance,
+}
+
+// listenTCP accepts connections streaming collectd's binary protocol
+func listenTCP(config ListenConfig, decoder *decoder, c chan collectd.Packet) {
+	listener, err := net.Listen("tcp", config.Bind)
+	if err != nil {
+		log.Fatalln("[fatal] Listen: failed to listen", err)
+	}
+	log.Printf("[info] Listen: listening for collectd streams on %s", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("[error] Listen: Failed to accept connection", err)
+			errorCounts.Add("fetch.receive", 1)
+			continue
+		}
+		go receiveStream(conn, config, decoder, c)
+	}
+}
+
+// receiveStream reads collectd's binary protocol off a connection. As there
+// are no datagram boundaries, the stream is read a part at a time, and each
+// values part is decoded along with the identifier parts that preceded it.
+func receiveStream(conn net.Conn, config ListenConfig, decoder *decoder, c chan collectd.Packet) {
+	defer conn.Close()
+	source := conn.RemoteAddr().String()
+	r := bufio.NewReader(conn)
+
+	parts := map[uint16][]byte{}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				errorCounts.Add("fetch.receive", 1)
+			}
+			return
+		}
+		kind := binary.BigEndian.Uint16(header[0:2])
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < 4 {
+			// The stream can't be resynchronised
+			decoder.decode(header, source)
+			return
+		}
+		part := make([]byte, length)
+		copy(part, header)
+		if _, err := io.ReadFull(r, part[4:]); err != nil {
+			errorCounts.Add("fetch.receive", 1)
+			return
+		}
+
+		switch kind {
+		case collectd.ParseValues:
+			listenCounts.Add("raw", 1)
+			var buf []byte
+			for _, k := range streamParts {
+				buf = append(buf, parts[k]...)
+			}
+			buf = append(buf, part...)
+			for _, p := range decoder.decode(buf, source) {
+				accept(config, c, p)
+			}
+		case collectd.ParseMessage:
+			var buf []byte
+			for _, k := range streamParts {
+				buf = append(buf, parts[k]...)
+			}
+			buf = append(buf, part...)
+			for _, n := range parseNotifications(buf) {
+				acceptNotification(config, n)
+			}
+		case collectd.ParseSignature, collectd.ParseEncryption:
+			// Decoded so they're counted as unsupported
+			decoder.decode(part, source)
+		default:
+			parts[kind] = part
+		}
+	}
+}
+
+// WriteHTTPSample is a sample as POSTed by collectd's write_http plugin with
+// Format "JSON"
+type WriteHTTPSample struct {
+	Values         []*float64 `json:"values"`
+	DSTypes        []string   `json:"dstypes"`
+	DSNames        []string   `json:"dsnames"`
+	Time           float64    `json:"time"`
+	Interval       float64    `json:"interval"`
+	Host           string     `json:"host"`
+	Plugin         string     `json:"plugin"`
+	PluginInstance string     `json:"plugin_instance"`
+	Type           string     `json:"type"`
+	TypeInstance   string     `json:"type_instance"`
+	// Only set on notifications
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+var valueTypes = map[string]uint8{
+	"counter":  collectd.TypeCounter,
+	"gauge":    collectd.TypeGauge,
+	"derive":   collectd.TypeDerive,
+	"absolute": collectd.TypeAbsolute,
+}
+
+var severities = map[string]uint64{
+	"FAILURE": SeverityFailure,
+	"WARNING": SeverityWarning,
+	"OKAY":    SeverityOkay,
+}
+
+// IsNotification determines if write_http POSTed a notification rather than
+// a sample
+func (s WriteHTTPSample) IsNotification() bool {
+	return len(s.Severity) > 0
+}
+
+// Notification converts a write_http notification into a Notification
+func (s WriteHTTPSample) Notification() (Notification, error) {
+	n := Notification{Message: s.Message}
+	severity, ok := severities[strings.ToUpper(s.Severity)]
+	if !ok {
+		return n, fmt.Errorf("unknown severity '%s'", s.Severity)
+	}
+	n.Severity = severity
+	n.Packet, _ = WriteHTTPSample{
+		Host:           s.Host,
+		Plugin:         s.Plugin,
+		PluginInstance: s.PluginInstance,
+		Type:           s.Type,
+		TypeInstance:   s.TypeInstance,
+		Time:           s.Time,
+	}.Packet()
+	return n, nil
+}
+
+// Packet converts a write_http sample into a collectd packet. Times are
+// converted to collectd's high resolution format, which is in units of 2^-30
+// seconds.
+func (s WriteHTTPSample) Packet() (collectd.Packet, error) {
+	packet := collectd.Packet{
+		Hostname:       s.Host,
+		Plugin:         s.Plugin,
+		PluginInstance: s.PluginInstance,
+		Type:           s.Type,
+		TypeInstance:   s.TypeInstance,
+		TimeHR:         uint64(s.Time * (1 << 30)),
+		IntervalHR:     uint64(s.Interval * (1 << 30)),
+	}
+	if len(s.DSTypes) != len(s.Values) || len(s.DSNames) != len(s.Values) {
+		return packet, fmt.Errorf("%d values, but %d dstypes and %d dsnames", len(s.Values), len(s.DSTypes), len(s.DSNames))
+	}
+	for i, v := range s.Values {
+		t, ok := valueTypes[s.DSTypes[i]]
+		if !ok {
+			return packet, fmt.Errorf("unknown dstype '%s'", s.DSTypes[i])
+		}
+		value := collectd.Value{Name: s.DSNames[i], Type: t, TypeName: collectd.ValueTypeValues[t], Value: math.NaN()}
+		// write_http sends NaN as null
+		if v != nil {
+			value.Value = *v
+		}
+		packet.Values = append(packet.Values, value)
+	}
+	return packet, nil
+}
+
+// listenHTTP accepts samples POSTed as JSON by collectd's write_http plugin
+func listenHTTP(config ListenConfig, c chan collectd.Packet) {
+	decoder, err := newDecoder(config, nil)
+	if err != nil {
+		log.Fatalln("[fatal] Listen: failed to open capture file", err)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			errorCounts.Add("fetch.receive", 1)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		listenCounts.Add("raw", 1)
+
+		var samples []WriteHTTPSample
+		var packets []collectd.Packet
+		var notes []Notification
+		err = json.Unmarshal(body, &samples)
+		for _, s := range samples {
+			if err != nil {
+				break
+			}
+			if s.IsNotification() {
+				var n Notification
+				n, err = s.Notification()
+				notes = append(notes, n)
+				continue
+			}
+			var p collectd.Packet
+			p, err = s.Packet()
+			packets = append(packets, p)
+		}
+		if err != nil {
+			errorCounts.Add("listen.decode.malformed", 1)
+			decoder.report(body, r.RemoteAddr, "malformed", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, p := range packets {
+			accept(config, c, p)
+		}
+		for _, n := range notes {
+			acceptNotification(config, n)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	log.Printf("[info] Listen: listening for write_http samples on %s", config.Bind)
+	log.Fatalf("[fatal] Listen: HTTP handler crashed: %s", http.ListenAndServe(config.Bind, http.HandlerFunc(handler)))
+}
@@ -0,0 +1,238 @@
+package coco
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// How long a host stays listed as limited after its last sample was dropped
+const limitedWindow = time.Minute
+
+// Samples dropped by rate limits, by which limit dropped them
+var limitCounts = expvar.NewMap("coco.limited")
+
+// LimitsConfig describes the rate limits applied to samples by Filter. Rates
+// are in samples per second, and 0 means unlimited. Bursts are how many
+// samples can be accepted at once, and default to one second's worth.
+type LimitsConfig struct {
+	HostRate    Rate `toml:"host_rate"`
+	HostBurst   int  `toml:"host_burst"`
+	MetricRate  Rate `toml:"metric_rate"`
+	MetricBurst int  `toml:"metric_burst"`
+}
+
+// Rate is a number of samples per second. Rates below 1 are useful for
+// limiting metrics, e.g. 0.1 for collectd's default interval of 10s.
+type Rate float64
+
+// UnmarshalTOML decodes a rate written as either an integer or a float
+func (r *Rate) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case int64:
+		*r = Rate(v)
+	case float64:
+		*r = Rate(v)
+	default:
+		return fmt.Errorf("invalid rate %v: must be a number", data)
+	}
+	return nil
+}
+
+// Validate checks the rates and bursts are sane
+func (l *LimitsConfig) Validate() error {
+	if l.HostRate < 0 || l.MetricRate < 0 {
+		return fmt.Errorf("invalid rate limit: rates can't be negative")
+	}
+	if l.HostBurst < 0 || l.MetricBurst < 0 {
+		return fmt.Errorf("invalid rate limit: bursts can't be negative")
+	}
+	return nil
+}
+
+// Helper function to provide a default burst for the host limit
+func (l *LimitsConfig) HostBurstSize() float64 {
+	return burstSize(l.HostBurst, l.HostRate)
+}
+
+// Helper function to provide a default burst for the host/metric limit
+func (l *LimitsConfig) MetricBurstSize() float64 {
+	return burstSize(l.MetricBurst, l.MetricRate)
+}
+
+func burstSize(burst int, rate Rate) float64 {
+	if burst == 0 {
+		// Always let at least one sample through
+		if rate < 1 {
+			return 1
+		}
+		return float64(rate)
+	} else {
+		return float64(burst)
+	}
+}
+
+// bucket is a token bucket, refilled at a limit's rate up to its burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accrued since the bucket was last refilled
+func (b *bucket) refill(now time.Time, rate float64, burst float64) {
+	b.tokens += rate * now.Sub(b.last).Seconds()
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// LimitedHost describes a host that has had samples dropped by rate limits
+type LimitedHost struct {
+	// Samples dropped by the host limit, and by host/metric limits
+	Host    int64            `json:"host"`
+	Metrics map[string]int64 `json:"metrics"`
+	// When a sample was last dropped
+	Last int64 `json:"last"`
+}
+
+// Limiter applies per host and per host/metric rate limits to samples
+type Limiter struct {
+	config LimitsConfig
+
+	lock    sync.Mutex
+	hosts   map[string]*bucket
+	metrics map[string]*bucket
+	limited map[string]*LimitedHost
+	swept   time.Time
+}
+
+// NewLimiter sets up a Limiter. If the config has no limits, every sample is
+// allowed.
+func NewLimiter(config LimitsConfig) *Limiter {
+	limitCounts.Add("host", 0)
+	limitCounts.Add("metric", 0)
+
+	l := &Limiter{
+		config:  config,
+		hosts:   make(map[string]*bucket),
+		metrics: make(map[string]*bucket),
+		limited: make(map[string]*LimitedHost),
+		swept:   time.Now(),
+	}
+	limitCounts.Set("hosts", expvar.Func(func() interface{} {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return len(l.limited)
+	}))
+	return l
+}
+
+// Allow determines if a sample for a host and metric is within the limits.
+// Samples that are allowed count against both limits.
+func (l *Limiter) Allow(host string, metric string) bool {
+	if l == nil || (l.config.HostRate == 0 && l.config.MetricRate == 0) {
+		return true
+	}
+	now := time.Now()
+	key := host + "/" + metric
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+
+	var hb, mb *bucket
+	if l.config.HostRate > 0 {
+		hb = l.take(l.hosts, host, now, float64(l.config.HostRate), l.config.HostBurstSize())
+		if hb.tokens < 1 {
+			l.record(host, "", now)
+			return false
+		}
+	}
+	if l.config.MetricRate > 0 {
+		mb = l.take(l.metrics, key, now, float64(l.config.MetricRate), l.config.MetricBurstSize())
+		if mb.tokens < 1 {
+			l.record(host, metric, now)
+			return false
+		}
+	}
+
+	if hb != nil {
+		hb.tokens -= 1
+	}
+	if mb != nil {
+		mb.tokens -= 1
+	}
+	return true
+}
+
+// take finds or creates the bucket for a key, and refills it. New buckets
+// start full.
+func (l *Limiter) take(buckets map[string]*bucket, key string, now time.Time, rate float64, burst float64) *bucket {
+	b := buckets[key]
+	if b == nil {
+		b = &bucket{tokens: burst, last: now}
+		buckets[key] = b
+	}
+	b.refill(now, rate, burst)
+	return b
+}
+
+// record counts a sample dropped by the host limit, or a host/metric limit if
+// metric is set.
+func (l *Limiter) record(host string, metric string, now time.Time) {
+	h := l.limited[host]
+	if h == nil {
+		h = &LimitedHost{Metrics: make(map[string]int64)}
+		l.limited[host] = h
+	}
+	if len(metric) == 0 {
+		h.Host += 1
+		limitCounts.Add("host", 1)
+	} else {
+		h.Metrics[metric] += 1
+		limitCounts.Add("metric", 1)
+	}
+	h.Last = now.Unix()
+}
+
+// sweep forgets buckets that have refilled, as they're no different to new
+// ones, and hosts that haven't been limited recently. It runs at most once per
+// window, so it doesn't slow down Allow.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < limitedWindow {
+		return
+	}
+	l.swept = now
+	sweepBuckets(l.hosts, now, float64(l.config.HostRate), l.config.HostBurstSize())
+	sweepBuckets(l.metrics, now, float64(l.config.MetricRate), l.config.MetricBurstSize())
+	for host, h := range l.limited {
+		if now.Unix()-h.Last > int64(limitedWindow.Seconds()) {
+			delete(l.limited, host)
+		}
+	}
+}
+
+func sweepBuckets(buckets map[string]*bucket, now time.Time, rate float64, burst float64) {
+	for key, b := range buckets {
+		if b.tokens+rate*now.Sub(b.last).Seconds() >= burst {
+			delete(buckets, key)
+		}
+	}
+}
+
+// Limited returns the hosts that have had samples dropped within the last
+// minute, encoded as JSON.
+func (l *Limiter) Limited() []byte {
+	result := map[string]*LimitedHost{}
+	if l != nil {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		l.sweep(time.Now())
+		result = l.limited
+	}
+	data, _ := json.Marshal(result)
+	return data
+}
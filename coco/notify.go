@@ -0,0 +1,187 @@
+package coco
+
+import (
+	"encoding/binary"
+	collectd "github.com/kimor79/gollectd"
+	"log"
+)
+
+// Severities of collectd notifications
+const (
+	SeverityFailure = 1
+	SeverityWarning = 2
+	SeverityOkay    = 4
+)
+
+// How notifications are dispatched to a tier's targets
+const (
+	// Dispatch to the target the notification's host hashes to
+	NotifyRoute = "route"
+	// Dispatch to every target in the tier
+	NotifyBroadcast = "broadcast"
+)
+
+// Notification is a collectd notification, e.g. a threshold alert. Packet
+// holds the notification's host, time, and what it is about, and never has
+// any values.
+type Notification struct {
+	Packet   collectd.Packet
+	Severity uint64
+	Message  string
+}
+
+// parseNotifications extracts the notifications from a collectd packet.
+// gollectd skips over notifications, as they have no values. Like values,
+// each notification is made up of the parts preceding its message part.
+func parseNotifications(payload []byte) []Notification {
+	var result []Notification
+	var n Notification
+	for len(payload) >= 4 {
+		kind := binary.BigEndian.Uint16(payload[0:2])
+		length := int(binary.BigEndian.Uint16(payload[2:4]))
+		if length < 4 || length > len(payload) {
+			break
+		}
+		body := payload[4:length]
+		payload = payload[length:]
+
+		str := func() string {
+			if len(body) == 0 {
+				return ""
+			}
+			// Strip the terminating null byte
+			return string(body[:len(body)-1])
+		}
+		num := func() uint64 {
+			if len(body) != 8 {
+				return 0
+			}
+			return binary.BigEndian.Uint64(body)
+		}
+
+		switch kind {
+		case collectd.ParseHost:
+			n.Packet.Hostname = str()
+		case collectd.ParseTime:
+			n.Packet.Time = num()
+		case collectd.ParseTimeHR:
+			n.Packet.TimeHR = num()
+		case collectd.ParsePlugin:
+			n.Packet.Plugin = str()
+		case collectd.ParsePluginInstance:
+			n.Packet.PluginInstance = str()
+		case collectd.ParseType:
+			n.Packet.Type = str()
+		case collectd.ParseTypeInstance:
+			n.Packet.TypeInstance = str()
+		case collectd.ParseSeverity:
+			n.Severity = num()
+		case collectd.ParseMessage:
+			n.Message = str()
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// acceptNotification applies a listener's default tags to a notification, and
+// queues it for Send. Notifications skip Filter, as the blacklist only applies
+// to metrics. They are dropped if the listener has no queue for them, or the
+// queue is full and its policy drops them.
+func acceptNotification(config ListenConfig, n Notification) {
+	for k, v := range config.Tags {
+		if field := tagFields[k](&n.Packet); len(*field) == 0 {
+			*field = v
+		}
+	}
+	listenCounts.Add("notifications", 1)
+	if config.Notifications == nil {
+		dropCounts.Add("notifications", 1)
+		return
+	}
+	enqueue("notifications", config.NotificationsQueue, config.Notifications, n)
+}
+
+// appendString appends a string part to a collectd packet
+func appendString(buf []byte, kind uint16, s string) []byte {
+	part := make([]byte, 4, 4+len(s)+1)
+	binary.BigEndian.PutUint16(part[0:2], kind)
+	binary.BigEndian.PutUint16(part[2:4], uint16(4+len(s)+1))
+	part = append(part, s...)
+	part = append(part, 0)
+	return append(buf, part...)
+}
+
+// appendNumber appends a numeric part to a collectd packet
+func appendNumber(buf []byte, kind uint16, v uint64) []byte {
+	part := make([]byte, 12)
+	binary.BigEndian.PutUint16(part[0:2], kind)
+	binary.BigEndian.PutUint16(part[2:4], 12)
+	binary.BigEndian.PutUint64(part[4:], v)
+	return append(buf, part...)
+}
+
+// EncodeNotification encodes a Notification into the collectd wire protocol
+// format.
+func EncodeNotification(n Notification) ([]byte, error) {
+	p := n.Packet
+	fields := map[string]string{
+		"host":            p.Hostname,
+		"plugin":          p.Plugin,
+		"plugin_instance": p.PluginInstance,
+		"type":            p.Type,
+		"type_instance":   p.TypeInstance,
+		"message":         n.Message,
+	}
+	for field, s := range fields {
+		if err := validateString(field, s); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := appendString(nil, collectd.ParseHost, p.Hostname)
+	if p.TimeHR > 0 {
+		buf = appendNumber(buf, collectd.ParseTimeHR, p.TimeHR)
+	} else if p.Time > 0 {
+		buf = appendNumber(buf, collectd.ParseTime, p.Time)
+	}
+	buf = appendNumber(buf, collectd.ParseSeverity, n.Severity)
+	buf = appendString(buf, collectd.ParsePlugin, p.Plugin)
+	if len(p.PluginInstance) > 0 {
+		buf = appendString(buf, collectd.ParsePluginInstance, p.PluginInstance)
+	}
+	if len(p.Type) > 0 {
+		buf = appendString(buf, collectd.ParseType, p.Type)
+	}
+	if len(p.TypeInstance) > 0 {
+		buf = appendString(buf, collectd.ParseTypeInstance, p.TypeInstance)
+	}
+	buf = appendString(buf, collectd.ParseMessage, n.Message)
+	return buf, nil
+}
+
+// notify dispatches a notification to the tiers, either to the target its
+// host hashes to, or to every target.
+func notify(tiers *[]Tier, n Notification) {
+	payload, err := EncodeNotification(n)
+	if err != nil {
+		errorCounts.Add("send.notification", 1)
+		return
+	}
+	for i, _ := range *tiers {
+		tier := &(*tiers)[i]
+		targets := tier.Targets
+		if tier.Notifications != NotifyBroadcast {
+			target, err := tier.Lookup(n.Packet.Hostname)
+			if err != nil {
+				log.Fatalf("[fatal] Send: couldn't lookup target: %s\n", err)
+			}
+			targets = []string{target}
+		}
+		for _, target := range targets {
+			if tier.dispatch(target, payload, 0) {
+				sendCounts.Add("notifications", 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package coco
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is the routing metadata persisted across restarts
+type Snapshot struct {
+	Time int64 `json:"time"`
+	// map[tier]map[target]map[sample host]map[sample metric name]last dispatched
+	Routes      map[string]map[string]map[string]map[string]int64 `json:"routes"`
+	Blacklisted map[string]map[string]int64                       `json:"blacklisted"`
+}
+
+// copyMetrics copies a map of metrics to when they were last seen
+func copyMetrics(metrics map[string]map[string]int64) map[string]map[string]int64 {
+	c := make(map[string]map[string]int64, len(metrics))
+	for host, names := range metrics {
+		c[host] = make(map[string]int64, len(names))
+		for name, ts := range names {
+			c[host][name] = ts
+		}
+	}
+	return c
+}
+
+// copyRoutes copies a tier's Mappings, so they can be serialised without
+// holding routesLock. Must be called with routesLock held.
+func copyRoutes(mappings map[string]map[string]map[string]int64) map[string]map[string]map[string]int64 {
+	c := make(map[string]map[string]map[string]int64, len(mappings))
+	for target, hosts := range mappings {
+		c[target] = copyMetrics(hosts)
+	}
+	return c
+}
+
+// takeSnapshot serialises the routing metadata for all tiers, and the
+// blacklisted metrics. They are copied under their locks and serialised
+// outside them, so Send isn't held up while a large snapshot is encoded.
+func takeSnapshot(tiers *[]Tier, blacklisted *map[string]map[string]int64) ([]byte, error) {
+	snapshot := Snapshot{
+		Time:   time.Now().Unix(),
+		Routes: make(map[string]map[string]map[string]map[string]int64),
+	}
+
+	routesLock.RLock()
+	for _, tier := range *tiers {
+		snapshot.Routes[tier.Name] = copyRoutes(tier.Mappings)
+	}
+	routesLock.RUnlock()
+
+	blacklistLock.RLock()
+	snapshot.Blacklisted = copyMetrics(*blacklisted)
+	blacklistLock.RUnlock()
+
+	return json.Marshal(snapshot)
+}
+
+// writeAtomically writes data to a temporary file next to path, then renames
+// it over path, so a crash mid-write never leaves a truncated file behind.
+func writeAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Persist periodically snapshots the routing metadata and blacklisted metrics
+// to disk, so they can be restored when Coco restarts.
+func Persist(config PersistConfig, tiers *[]Tier, blacklisted *map[string]map[string]int64) {
+	// Initialise the counts
+	persistCounts.Add("snapshots", 0)
+	errorCounts.Add("persist.write", 0)
+
+	if len(config.Path) == 0 {
+		log.Println("[info] Persist: no path configured, routing metadata will not be persisted")
+		return
+	}
+	log.Printf("[info] Persist: snapshotting routing metadata to %s every %s", config.Path, config.Interval())
+
+	tick := time.NewTicker(config.Interval()).C
+	for {
+		select {
+		case <-tick:
+			data, err := takeSnapshot(tiers, blacklisted)
+			if err == nil {
+				err = writeAtomically(config.Path, data)
+			}
+			if err != nil {
+				log.Printf("[error] Persist: couldn't snapshot routing metadata to %s: %s", config.Path, err)
+				errorCounts.Add("persist.write", 1)
+				continue
+			}
+			persistCounts.Add("snapshots", 1)
+			size := new(expvar.Int)
+			size.Set(int64(len(data)))
+			persistCounts.Set("bytes", size)
+		}
+	}
+}
+
+// Restore loads a snapshot of the routing metadata and blacklisted metrics
+// written by Persist. It must be called before the tiers are built and the
+// pipeline is started. Routes to targets no longer in a tier are dropped, and
+// BuildTiers drops routes for hosts that now hash to a different target.
+func Restore(config PersistConfig, tiers *[]Tier, blacklisted *map[string]map[string]int64) {
+	// Initialise the counts
+	errorCounts.Add("persist.restore", 0)
+
+	if len(config.Path) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(config.Path)
+	if os.IsNotExist(err) {
+		log.Printf("[info] Restore: no snapshot at %s, starting with empty routing metadata", config.Path)
+		return
+	}
+	var snapshot Snapshot
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil {
+		log.Printf("[warning] Restore: couldn't restore snapshot from %s: %s", config.Path, err)
+		log.Printf("[warning] Restore: starting with empty routing metadata")
+		errorCounts.Add("persist.restore", 1)
+		return
+	}
+
+	routesLock.Lock()
+	for i, tier := range *tiers {
+		if (*tiers)[i].Mappings == nil {
+			(*tiers)[i].Mappings = make(map[string]map[string]map[string]int64)
+		}
+		for target, hosts := range snapshot.Routes[tier.Name] {
+			if !tier.HasTarget(target) {
+				log.Printf("[info] Restore: dropping routes to '%s', which is no longer in tier '%s'", target, tier.Name)
+				continue
+			}
+			(*tiers)[i].Mappings[target] = hosts
+		}
+	}
+	routesLock.Unlock()
+
+	blacklistLock.Lock()
+	for host, metrics := range snapshot.Blacklisted {
+		(*blacklisted)[host] = metrics
+	}
+	blacklistLock.Unlock()
+
+	log.Printf("[info] Restore: restored routing metadata from %s, snapshotted at %s", config.Path, time.Unix(snapshot.Time, 0))
+}
+
+var (
+	persistCounts = expvar.NewMap("coco.persist")
+)
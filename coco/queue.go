@@ -0,0 +1,144 @@
+package coco
+
+import (
+	"expvar"
+	"fmt"
+)
+
+const defaultQueueSize = 1000000
+
+// Notifications are rare, so their queue is much smaller
+const defaultNotificationsQueueSize = 10000
+
+// Every queue, so drops are measured even for queues whose length isn't
+var queueNames = []string{"raw", "filtered", "blacklist", "notifications"}
+
+// Overflow policies for when a queue is full
+const (
+	// Wait for space on the queue. This stalls whatever is feeding the queue.
+	OverflowBlock = "block"
+	// Drop the sample being queued.
+	OverflowDropNewest = "drop-newest"
+	// Drop the sample at the head of the queue to make space.
+	OverflowDropOldest = "drop-oldest"
+)
+
+type QueuesConfig struct {
+	Raw           QueueConfig
+	Filtered      QueueConfig
+	Blacklist     QueueConfig
+	Notifications QueueConfig
+}
+
+// Helper function to provide defaults for the notifications queue. It is
+// small, and notifications are dropped when it's full rather than stalling
+// Listen.
+func (q *QueuesConfig) NotificationsQueue() QueueConfig {
+	n := q.Notifications
+	if n.Size == 0 {
+		n.Size = defaultNotificationsQueueSize
+	}
+	if len(n.Policy) == 0 {
+		n.Policy = OverflowDropNewest
+	}
+	return n
+}
+
+// Validate checks the config for every queue
+func (q *QueuesConfig) Validate() error {
+	queues := map[string]QueueConfig{
+		"raw":           q.Raw,
+		"filtered":      q.Filtered,
+		"blacklist":     q.Blacklist,
+		"notifications": q.Notifications,
+	}
+	for name, queue := range queues {
+		if err := queue.Validate(); err != nil {
+			return fmt.Errorf("queue '%s': %s", name, err)
+		}
+	}
+	return nil
+}
+
+type QueueConfig struct {
+	Size   int
+	Policy string
+}
+
+// Helper function to provide a default queue size
+func (q *QueueConfig) Capacity() int {
+	if q.Size == 0 {
+		return defaultQueueSize
+	} else {
+		return q.Size
+	}
+}
+
+// Helper function to provide a default overflow policy
+func (q *QueueConfig) Overflow() string {
+	if len(q.Policy) == 0 {
+		return OverflowBlock
+	} else {
+		return q.Policy
+	}
+}
+
+// Validate checks the queue size is sane, and the overflow policy is one we
+// know how to handle
+func (q *QueueConfig) Validate() error {
+	if q.Size < 0 {
+		return fmt.Errorf("invalid size %d", q.Size)
+	}
+	switch q.Overflow() {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+		return nil
+	default:
+		return fmt.Errorf("unknown overflow policy '%s'", q.Policy)
+	}
+}
+
+// enqueue puts a sample, blacklist item, or notification on the named queue,
+// applying the overflow policy if the queue is full. Unbuffered queues always
+// block.
+func enqueue[T any](name string, config QueueConfig, c chan T, item T) {
+	if cap(c) == 0 {
+		c <- item
+		return
+	}
+
+	switch config.Overflow() {
+	case OverflowDropNewest:
+		select {
+		case c <- item:
+		default:
+			dropCounts.Add(name, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case c <- item:
+				return
+			default:
+			}
+			select {
+			case <-c:
+				dropCounts.Add(name, 1)
+			default:
+			}
+		}
+	default:
+		c <- item
+	}
+}
+
+// dropped returns the number of samples dropped from a queue so far
+func dropped(name string) int64 {
+	if v, ok := dropCounts.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+var (
+	dropCounts = expvar.NewMap("coco.dropped")
+)
@@ -0,0 +1,228 @@
+package coco
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FilterRule is a blacklist regex added at runtime through the API. Like
+// [filter] blacklist, it is matched against "host/metric".
+type FilterRule struct {
+	ID      int    `json:"id"`
+	Pattern string `json:"pattern"`
+	Created int64  `json:"created"`
+	re      *regexp.Regexp
+}
+
+// FilterRules is the set of rules added through the API, shared by the Filter
+// workers and the API. If path is set, the rules are saved there every time
+// they change.
+type FilterRules struct {
+	path  string
+	lock  sync.RWMutex
+	rules []FilterRule
+	next  int
+}
+
+// NewFilterRules sets up a rule set, loading rules saved at path if it's set
+// and exists.
+func NewFilterRules(path string) (*FilterRules, error) {
+	errorCounts.Add("filter.rules", 0)
+
+	f := &FilterRules{path: path, next: 1}
+	if len(path) == 0 {
+		return f, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []FilterRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for _, rule := range rules {
+		rule.re, err = compileRule(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %s", path, rule.ID, err)
+		}
+		f.rules = append(f.rules, rule)
+		if rule.ID >= f.next {
+			f.next = rule.ID + 1
+		}
+	}
+	return f, nil
+}
+
+// compileRule validates and compiles a rule's pattern
+func compileRule(pattern string) (*regexp.Regexp, error) {
+	// An empty pattern would blacklist everything
+	if len(pattern) == 0 {
+		return nil, fmt.Errorf("pattern is empty")
+	}
+	return regexp.Compile(pattern)
+}
+
+// Match determines if "host/metric" is blacklisted by any rule
+func (f *FilterRules) Match(full string) bool {
+	if f == nil {
+		return false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for _, rule := range f.rules {
+		if rule.re.MatchString(full) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns a copy of the rules
+func (f *FilterRules) List() []FilterRule {
+	if f == nil {
+		return []FilterRule{}
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return append([]FilterRule{}, f.rules...)
+}
+
+// Add validates and adds a rule. The rules are saved before the rule is
+// applied, so a rule that can't be saved isn't applied.
+func (f *FilterRules) Add(pattern string) (FilterRule, error) {
+	re, err := compileRule(pattern)
+	if err != nil {
+		return FilterRule{}, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, rule := range f.rules {
+		if rule.Pattern == pattern {
+			return rule, errRuleExists
+		}
+	}
+	rule := FilterRule{ID: f.next, Pattern: pattern, Created: time.Now().Unix(), re: re}
+	rules := append(append([]FilterRule{}, f.rules...), rule)
+	if err := f.save(rules); err != nil {
+		return rule, err
+	}
+	f.rules = rules
+	f.next += 1
+	return rule, nil
+}
+
+// Remove removes a rule by ID. It returns false if there is no such rule.
+func (f *FilterRules) Remove(id int) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, rule := range f.rules {
+		if rule.ID != id {
+			continue
+		}
+		rules := append(append([]FilterRule{}, f.rules[:i]...), f.rules[i+1:]...)
+		if err := f.save(rules); err != nil {
+			return true, err
+		}
+		f.rules = rules
+		return true, nil
+	}
+	return false, nil
+}
+
+// save writes rules to the rules file, if there is one
+func (f *FilterRules) save(rules []FilterRule) error {
+	if len(f.path) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(rules)
+	if err == nil {
+		err = writeAtomically(f.path, data)
+	}
+	if err != nil {
+		log.Printf("[error] Filter: couldn't save rules to %s: %s", f.path, err)
+		errorCounts.Add("filter.rules", 1)
+		return errRulesNotSaved
+	}
+	return nil
+}
+
+var (
+	errRuleExists    = errors.New("a rule with that pattern already exists")
+	errRulesNotSaved = errors.New("couldn't save rules")
+	errNoRules       = errors.New("filter rules aren't enabled")
+)
+
+// ListFilters lists the rules added through the API
+func ListFilters(rules *FilterRules) (int, []byte) {
+	list := rules.List()
+	sort.Sort(byRuleID(list))
+	data, _ := json.Marshal(list)
+	return http.StatusOK, data
+}
+
+// AddFilter adds a rule POSTed as {"pattern": "..."}
+func AddFilter(req *http.Request, rules *FilterRules) (int, []byte) {
+	if rules == nil {
+		return errorResponse(http.StatusServiceUnavailable, errNoRules)
+	}
+	var body struct {
+		Pattern string `json:"pattern"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid JSON: %s", err))
+	}
+	rule, err := rules.Add(body.Pattern)
+	switch err {
+	case nil:
+	case errRuleExists:
+		return errorResponse(http.StatusConflict, fmt.Errorf("%s: %d", err, rule.ID))
+	case errRulesNotSaved:
+		return errorResponse(http.StatusInternalServerError, err)
+	default:
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid pattern: %s", err))
+	}
+	log.Printf("[info] Filter: added rule %d: %s", rule.ID, rule.Pattern)
+	data, _ := json.Marshal(rule)
+	return http.StatusCreated, data
+}
+
+// RemoveFilter removes a rule by ID
+func RemoveFilter(id string, rules *FilterRules) (int, []byte) {
+	if rules == nil {
+		return errorResponse(http.StatusServiceUnavailable, errNoRules)
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, fmt.Errorf("invalid rule id '%s'", id))
+	}
+	found, err := rules.Remove(n)
+	if !found {
+		return errorResponse(http.StatusNotFound, fmt.Errorf("unknown rule %d", n))
+	}
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, err)
+	}
+	log.Printf("[info] Filter: removed rule %d", n)
+	return http.StatusNoContent, []byte{}
+}
+
+type byRuleID []FilterRule
+
+func (r byRuleID) Len() int           { return len(r) }
+func (r byRuleID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRuleID) Less(i, j int) bool { return r[i].ID < r[j].ID }
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package coco
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SO_REUSEPORT isn't exported by syscall on Linux. This is its value on all
+// architectures except mips and sparc.
+const soReusePort = 0xf
+
+// listenUDP binds a UDP socket to addr. If reuse is set, SO_REUSEPORT is set
+// on the socket so multiple sockets can bind to the same address, and the
+// kernel balances datagrams between them. The socket's inode is returned so
+// kernel drops can be looked up.
+func listenUDP(addr string, reuse bool) (*net.UDPConn, uint64, error) {
+	var inode uint64
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if reuse {
+					serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+					if serr != nil {
+						return
+					}
+				}
+				var stat syscall.Stat_t
+				serr = syscall.Fstat(int(fd), &stat)
+				inode = stat.Ino
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	return conn.(*net.UDPConn), inode, nil
+}
+
+// readBuffer determines the receive buffer size the kernel actually gave a
+// socket, which may be capped by net.core.rmem_max.
+func readBuffer(conn *net.UDPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		size, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Linux doubles the requested size to allow for bookkeeping overhead
+	return size / 2, serr
+}
+
+// kernelDrops counts datagrams the kernel dropped for the sockets with the
+// given inodes, because their receive buffers were full.
+func kernelDrops(inodes []uint64) int64 {
+	wanted := map[string]bool{}
+	for _, inode := range inodes {
+		wanted[strconv.FormatUint(inode, 10)] = true
+	}
+
+	var drops int64
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+			// retrnsmt uid timeout inode ref pointer drops
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 13 || !wanted[fields[9]] {
+				continue
+			}
+			n, err := strconv.ParseInt(fields[12], 10, 64)
+			if err == nil {
+				drops += n
+			}
+		}
+		file.Close()
+	}
+	return drops
+}
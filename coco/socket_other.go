@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package coco
+
+import (
+	"errors"
+	"net"
+)
+
+// listenUDP binds a UDP socket to addr. SO_REUSEPORT is only supported on
+// Linux, so only one socket can be bound to an address elsewhere.
+func listenUDP(addr string, reuse bool) (*net.UDPConn, uint64, error) {
+	if reuse {
+		return nil, 0, errors.New("multiple sockets are only supported on Linux")
+	}
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	return conn, 0, err
+}
+
+// readBuffer can't determine the receive buffer size the kernel actually gave
+// a socket outside of Linux.
+func readBuffer(conn *net.UDPConn) (int, error) {
+	return 0, errors.New("unsupported")
+}
+
+// kernelDrops can't count drops outside of Linux.
+func kernelDrops(inodes []uint64) int64 {
+	return 0
+}
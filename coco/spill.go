@@ -0,0 +1,377 @@
+package coco
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Each spilled packet is stored as a record: the time it was spilled (8 bytes),
+// the length of the payload (4 bytes), and the payload itself.
+const spillHeaderSize = 12
+
+// The largest payload a UDP datagram can carry over IPv4. Larger packets can
+// never be written to a target.
+const maxDatagramSize = 65507
+
+/*
+Spool is an on-disk queue of encoded packets for a target that can't be
+written to.
+
+Once a write to the target fails, packets for the target are spilled until
+the next retry, when live packets are written to the target again and the
+backlog is replayed alongside them at a bounded rate. Replayed packets may
+arrive after newer live packets. The spool is truncated when it has been
+drained, and replayed packets are compacted out of it before it grows past
+its limit.
+
+Because writes to UDP targets can succeed even if nothing is listening,
+packets may be lost if the target goes away again mid-replay. If Coco
+restarts mid-replay, the spool is replayed from the last compaction, so some
+packets may be sent twice.
+*/
+type Spool struct {
+	Target string
+	Path   string
+	config SpillConfig
+
+	lock     sync.Mutex
+	file     *os.File
+	offset   int64 // where replay is up to
+	size     int64
+	packets  int64
+	oldest   int64
+	spilling bool // whether the target is down, so live packets are spilled
+	replayed int64
+	dropped  int64
+	// connection established by replay, if Send didn't have one
+	conn net.Conn
+}
+
+// spoolName builds a filesystem safe name for a target's spool
+func spoolName(target string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(target) + ".spill"
+}
+
+// NewSpool opens the spool for a target in a tier, picking up any packets
+// spilled before a restart.
+func NewSpool(config SpillConfig, tier string, target string) (*Spool, error) {
+	dir := filepath.Join(config.Path, tier)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, spoolName(target))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{Target: target, Path: path, config: config, file: file}
+
+	// Count what was left over from before a restart
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, spillHeaderSize)
+	for {
+		if _, err := file.ReadAt(header, s.size); err != nil {
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header[8:]))
+		if s.size+spillHeaderSize+length > info.Size() {
+			break
+		}
+		if s.packets == 0 {
+			s.oldest = int64(binary.BigEndian.Uint64(header[0:8]))
+		}
+		s.size += spillHeaderSize + length
+		s.packets += 1
+	}
+	// Drop any partially written record at the end
+	if err := file.Truncate(s.size); err != nil {
+		return nil, err
+	}
+	if s.packets > 0 {
+		log.Printf("[info] Spool: %d packets for '%s' left over from before restart will be replayed", s.packets, target)
+	}
+
+	return s, nil
+}
+
+// Spilling determines if live packets for the target should be spilled
+func (s *Spool) Spilling() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.spilling
+}
+
+// Conn returns the connection replay established to the target, if any
+func (s *Spool) Conn() net.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn
+}
+
+// Append spills a packet to disk, and spills subsequent packets until the
+// next retry. Packets are dropped if the spool is full, or if they are too
+// large to ever be written to the target. It returns whether the packet was
+// spilled.
+func (s *Spool) Append(payload []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(payload) > maxDatagramSize {
+		s.dropped += 1
+		errorCounts.Add("spill.unwritable", 1)
+		return false
+	}
+	s.spilling = true
+	record := int64(spillHeaderSize + len(payload))
+	// Only the backlog counts towards the limit, not what has been replayed
+	if s.size-s.offset+record > s.config.Limit() {
+		s.dropped += 1
+		errorCounts.Add("spill.full", 1)
+		return false
+	}
+	if s.size+record > s.config.Limit() {
+		if err := s.compact(); err != nil {
+			log.Printf("[error] Spool: couldn't compact spool for '%s': %s", s.Target, err)
+			s.dropped += 1
+			errorCounts.Add("spill.write", 1)
+			return false
+		}
+	}
+
+	now := time.Now().Unix()
+	buf := make([]byte, spillHeaderSize, record)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(now))
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(payload)))
+	buf = append(buf, payload...)
+	if _, err := s.file.Write(buf); err != nil {
+		s.dropped += 1
+		errorCounts.Add("spill.write", 1)
+		return false
+	}
+
+	if s.packets == 0 {
+		s.oldest = now
+	}
+	s.size += record
+	s.packets += 1
+	return true
+}
+
+// compact rewrites the spool without the records that have already been
+// replayed. Must be called with the lock held.
+func (s *Spool) compact() error {
+	tmp := s.Path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(s.file, s.offset, s.size-s.offset))
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err == nil {
+		err = os.Rename(tmp, s.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	file, err := os.OpenFile(s.Path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.size -= s.offset
+	s.offset = 0
+	return nil
+}
+
+// next reads the record at the replay offset. ok is false if there is nothing
+// left to replay, in which case the spool is truncated, or if the target has
+// gone down again.
+func (s *Spool) next() (payload []byte, ok bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.spilling {
+		return nil, false, nil
+	}
+	if s.offset >= s.size {
+		if err := s.file.Truncate(0); err != nil {
+			return nil, false, err
+		}
+		s.offset, s.size, s.packets, s.oldest = 0, 0, 0, 0
+		return nil, false, nil
+	}
+
+	header := make([]byte, spillHeaderSize)
+	if _, err := s.file.ReadAt(header, s.offset); err != nil {
+		return nil, false, err
+	}
+	s.oldest = int64(binary.BigEndian.Uint64(header[0:8]))
+	payload = make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := s.file.ReadAt(payload, s.offset+spillHeaderSize); err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	return payload, true, nil
+}
+
+// advance moves the replay offset past a replayed record. Records that were
+// skipped, because they can never be written, are counted as dropped.
+func (s *Spool) advance(payload []byte, skipped bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.offset += int64(spillHeaderSize + len(payload))
+	s.packets -= 1
+	if skipped {
+		s.dropped += 1
+	} else {
+		s.replayed += 1
+	}
+}
+
+// down spills live packets again, because a write to the target failed
+func (s *Spool) down() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.spilling = true
+}
+
+// recover writes live packets to the target again, and determines if there
+// is a backlog to replay
+func (s *Spool) recover() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.spilling = false
+	return s.offset < s.size
+}
+
+// drain replays spilled packets to the target at the configured rate, until
+// the spool is empty or a write fails.
+func (s *Spool) drain(conn net.Conn) error {
+	// Replay in small batches, so high rates don't need a high resolution timer
+	batch := s.config.Rate() / 100
+	if batch < 1 {
+		batch = 1
+	}
+	tick := time.NewTicker(time.Second * time.Duration(batch) / time.Duration(s.config.Rate()))
+	defer tick.Stop()
+
+	for {
+		for i := 0; i < batch; i++ {
+			payload, ok, err := s.next()
+			if err != nil || !ok {
+				return err
+			}
+			if _, err := conn.Write(payload); err != nil {
+				// Don't let a packet that can never be written block
+				// the rest of the backlog
+				if len(payload) > maxDatagramSize || errors.Is(err, syscall.EMSGSIZE) {
+					errorCounts.Add("spill.unwritable", 1)
+					s.advance(payload, true)
+					continue
+				}
+				s.down()
+				return err
+			}
+			s.advance(payload, false)
+		}
+		<-tick.C
+	}
+}
+
+// Replay periodically tries writing live packets to the target again, and
+// drains the backlog to it while it can be written to.
+func (s *Spool) Replay(conn net.Conn) {
+	tick := time.NewTicker(s.config.Retry()).C
+	for {
+		<-tick
+
+		// Try to establish a connection if Send never had one
+		if conn == nil {
+			c, err := net.Dial("udp", s.Target)
+			if err != nil {
+				continue
+			}
+			conn = c
+			s.lock.Lock()
+			s.conn = c
+			s.lock.Unlock()
+		}
+
+		if !s.recover() {
+			continue
+		}
+		if err := s.drain(conn); err != nil {
+			errorCounts.Add("spill.replay", 1)
+			continue
+		}
+		// A live packet couldn't be written, so the target is down again
+		if s.Spilling() {
+			continue
+		}
+		log.Printf("[info] Spool: finished replaying spilled packets to '%s'", s.Target)
+	}
+}
+
+// Stats reports the size and age of the backlog, for expvar
+func (s *Spool) Stats() interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var age int64
+	if s.packets > 0 {
+		age = time.Now().Unix() - s.oldest
+	}
+	return map[string]int64{
+		"packets":  s.packets,
+		"bytes":    s.size - s.offset,
+		"age":      age,
+		"replayed": s.replayed,
+		"dropped":  s.dropped,
+	}
+}
+
+// buildSpools sets up a spool for every target in a tier, if spilling is
+// enabled, and starts replaying any left over from before a restart.
+func buildSpools(tier *Tier) {
+	if len(tier.Spill.Path) == 0 {
+		return
+	}
+	if tier.Spill.Limit() <= 0 || tier.Spill.Rate() <= 0 {
+		log.Fatalf("[fatal] BuildTiers: spill max_bytes and replay_rate must be positive in tier '%s'", tier.Name)
+	}
+
+	tier.Spools = make(map[string]*Spool)
+	tierStats := new(expvar.Map).Init()
+	for _, t := range tier.Targets {
+		spool, err := NewSpool(tier.Spill, tier.Name, t)
+		if err != nil {
+			log.Fatalf("[fatal] BuildTiers: couldn't open spool for '%s': %s", t, err)
+		}
+		tier.Spools[t] = spool
+		tierStats.Set(t, expvar.Func(spool.Stats))
+		go spool.Replay(tier.Connections[t])
+	}
+	spillCounts.Set(tier.Name, tierStats)
+}
+
+var (
+	spillCounts = expvar.NewMap("coco.spill")
+)
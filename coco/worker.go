@@ -0,0 +1,47 @@
+package coco
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// Samples processed by each worker, e.g. filter.0
+	workerCounts = expvar.NewMap("coco.workers")
+	// Samples per second processed by each worker, as of the last measurement
+	throughputCounts = expvar.NewMap("coco.throughput")
+
+	workersLock sync.Mutex
+	workerIDs   = map[string]int{}
+	// How many samples each worker had processed at the last measurement
+	measured = map[string]int64{}
+)
+
+// newWorker registers a worker for a pipeline stage, returning the counter it
+// increments for every sample it processes.
+func newWorker(stage string) *expvar.Int {
+	workersLock.Lock()
+	name := stage + "." + strconv.Itoa(workerIDs[stage])
+	workerIDs[stage] += 1
+	workersLock.Unlock()
+
+	processed := new(expvar.Int)
+	workerCounts.Set(name, processed)
+	throughputCounts.Set(name, new(expvar.Float))
+	return processed
+}
+
+// measureThroughput calculates the samples per second each worker processed
+// over the last interval.
+func measureThroughput(interval time.Duration) {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+	workerCounts.Do(func(kv expvar.KeyValue) {
+		processed := kv.Value.(*expvar.Int).Value()
+		rate := float64(processed-measured[kv.Key]) / interval.Seconds()
+		throughputCounts.Get(kv.Key).(*expvar.Float).Set(rate)
+		measured[kv.Key] = processed
+	})
+}
@@ -6,6 +6,9 @@ import (
 	collectd "github.com/kimor79/gollectd"
 	"gopkg.in/alecthomas/kingpin.v1"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -22,15 +25,62 @@ func main() {
 		return
 	}
 
+	if err := config.Queues.Validate(); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	if err := config.Limits.Validate(); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	if err := config.Cardinality.Validate(); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	if err := config.Filter.Validate(); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	if err := config.Send.Validate(); err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	if len(config.Listen) == 0 {
+		log.Fatal("[fatal] No listeners configured. Exiting.")
+	}
+
 	// Setup data structures to be shared across components
 	blacklisted := map[string]map[string]int64{}
-	raw := make(chan collectd.Packet, 1000000)
-	filtered := make(chan collectd.Packet, 1000000)
-	items := make(chan coco.BlacklistItem, 1000000)
+	raw := make(chan collectd.Packet, config.Queues.Raw.Capacity())
+	filtered := make(chan collectd.Packet, config.Queues.Filtered.Capacity())
+	items := make(chan coco.BlacklistItem, config.Queues.Blacklist.Capacity())
+	notificationsQueue := config.Queues.NotificationsQueue()
+	notifications := make(chan coco.Notification, notificationsQueue.Capacity())
+
+	for i, _ := range config.Listen {
+		config.Listen[i].Queue = config.Queues.Raw
+		config.Listen[i].Notifications = notifications
+		config.Listen[i].NotificationsQueue = notificationsQueue
+	}
+	config.Filter.Filtered = config.Queues.Filtered
+	config.Filter.Blacklisted = config.Queues.Blacklist
+	limiter := coco.NewLimiter(config.Limits)
+	config.Filter.Limiter = limiter
+	config.Api.Limiter = limiter
+	rules, err := coco.NewFilterRules(config.Filter.RulesPath)
+	if err != nil {
+		log.Fatalf("[fatal] Filter: couldn't load rules: %s", err)
+	}
+	config.Filter.Rules = rules
+	config.Api.Rules = rules
+	aggregator, err := coco.NewAggregator(config.Aggregate)
+	if err != nil {
+		log.Fatalf("[fatal] %s", err)
+	}
+	config.Filter.Aggregator = aggregator
 
 	var tiers []coco.Tier
 	for k, v := range config.Tiers {
-		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tier := coco.Tier{Name: k, Targets: v.Targets, Endpoints: v.Fetch, Spill: config.Spill}
+		tier.Batch = coco.BatchConfig{MaxPacketSize: v.MaxPacketSize, FlushInterval: v.FlushInterval}
+		tier.Downsample = coco.DownsampleConfig{MinInterval: v.MinInterval, Aggregate: v.Aggregate}
+		tier.Notifications = v.Notifications
+		tier.Cardinality = config.Cardinality
 		tiers = append(tiers, tier)
 	}
 
@@ -38,6 +88,9 @@ func main() {
 		log.Fatal("No tiers configured. Exiting.")
 	}
 
+	// Pick up where we left off before a restart
+	coco.Restore(config.Persist, &tiers, &blacklisted)
+
 	chans := map[string]chan collectd.Packet{
 		"raw":      raw,
 		"filtered": filtered,
@@ -46,11 +99,26 @@ func main() {
 	go coco.Measure(config.Measure, chans, &tiers)
 
 	// Launch components to do the work
-	go coco.Listen(config.Listen, raw)
-	for i := 0; i < 4; i++ {
+	for _, l := range config.Listen {
+		go coco.Listen(l, raw)
+	}
+	for i := 0; i < config.Filter.Concurrency(); i++ {
 		go coco.Filter(config.Filter, raw, filtered, items)
 	}
+	go coco.Aggregate(aggregator, config.Queues.Filtered, filtered)
 	go coco.Blacklist(items, &blacklisted)
-	go coco.Send(&tiers, filtered)
+	go coco.Expire(config.Expire, &tiers, &blacklisted)
+	go coco.Persist(config.Persist, &tiers, &blacklisted)
+	go coco.SendWorkers(config.Send, &tiers, filtered, notifications)
+
+	// Reload types.db on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			coco.ReloadTypesDB()
+		}
+	}()
+
 	coco.Api(config.Api, &tiers, &blacklisted)
 }
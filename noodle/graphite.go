@@ -0,0 +1,311 @@
+package noodle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bulletproofnetworks/coco/coco"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Graphite paths are mapped onto Visage's host/plugin/instance/ds hierarchy:
+
+  host_example_org.cpu-0.cpu-user.value
+
+Dots in hostnames are replaced with underscores, because Graphite uses dots to
+separate path components, and underscores are doubled so the hostname can be
+recovered, e.g. web_01.example.org is web__01_example_org. Hostnames can't be enumerated from a target, so the
+first component of every path must be a literal hostname. The other components
+can contain Graphite's *, ?, and [...] wildcards.
+*/
+
+// GraphiteSeries is a series in Graphite's render API JSON format
+type GraphiteSeries struct {
+	Target     string      `json:"target"`
+	Datapoints []Datapoint `json:"datapoints"`
+}
+
+// Datapoint is a Point that is encoded as a [value, timestamp] pair, which is
+// the reverse of Point.
+type Datapoint Point
+
+// MarshalJSON encodes a Datapoint as a [value, timestamp] pair
+func (d Datapoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{d.Value, d.Timestamp})
+}
+
+// GraphiteNode is a node in Graphite's metrics find API JSON format
+type GraphiteNode struct {
+	Text          string `json:"text"`
+	Id            string `json:"id"`
+	Leaf          int    `json:"leaf"`
+	Expandable    int    `json:"expandable"`
+	AllowChildren int    `json:"allowChildren"`
+}
+
+// Escape hostnames as Graphite path components, and back again. Replacers
+// match from left to right, so __ is unescaped before _.
+var (
+	graphiteHostEscaper   = strings.NewReplacer("_", "__", ".", "_")
+	graphiteHostUnescaper = strings.NewReplacer("__", "_", "_", ".")
+)
+
+// graphiteHost converts a hostname into a Graphite path component
+func graphiteHost(host string) string {
+	return graphiteHostEscaper.Replace(host)
+}
+
+// visageHost converts a Graphite path component into a hostname
+func visageHost(component string) string {
+	return graphiteHostUnescaper.Replace(component)
+}
+
+func isPattern(component string) bool {
+	return strings.ContainsAny(component, "*?[")
+}
+
+// graphitePath builds the Graphite path components for a series
+func graphitePath(s Series) []string {
+	return []string{graphiteHost(s.Host), s.plugin, s.instance, s.Ds}
+}
+
+// matches determines if Graphite path components match a pattern, up to the
+// length of the pattern.
+func matches(components []string, pattern []string) bool {
+	if len(pattern) > len(components) {
+		return false
+	}
+	for i, p := range pattern {
+		ok, err := path.Match(p, components[i])
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+var relativeTime = regexp.MustCompile(`^-(\d+)(s|sec|secs|seconds?|min|mins|minutes?|h|hours?|d|days?|w|weeks?|mon|months?|y|years?)$`)
+
+// parseGraphiteTime converts a Graphite from/until value into a Unix
+// timestamp. Supports "now", Unix timestamps, and relative times like "-1h".
+func parseGraphiteTime(value string, now time.Time) (int64, error) {
+	if value == "now" {
+		return now.Unix(), nil
+	}
+	if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ts, nil
+	}
+	m := relativeTime.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("unsupported time '%s'", value)
+	}
+	n, _ := strconv.ParseInt(m[1], 10, 64)
+	var unit int64
+	switch {
+	case strings.HasPrefix(m[2], "s"):
+		unit = 1
+	case strings.HasPrefix(m[2], "mi"):
+		unit = 60
+	case strings.HasPrefix(m[2], "h"):
+		unit = 60 * 60
+	case strings.HasPrefix(m[2], "d"):
+		unit = 24 * 60 * 60
+	case strings.HasPrefix(m[2], "w"):
+		unit = 7 * 24 * 60 * 60
+	case strings.HasPrefix(m[2], "mo"):
+		unit = 30 * 24 * 60 * 60
+	case strings.HasPrefix(m[2], "y"):
+		unit = 365 * 24 * 60 * 60
+	}
+	return now.Unix() - n*unit, nil
+}
+
+// graphiteWindow converts Graphite's from/until parameters into the
+// start/finish parameters Visage understands.
+func graphiteWindow(form url.Values) (url.Values, error) {
+	now := time.Now()
+	from := form.Get("from")
+	if len(from) == 0 {
+		from = "-24h"
+	}
+	until := form.Get("until")
+	if len(until) == 0 {
+		until = "now"
+	}
+
+	start, err := parseGraphiteTime(from, now)
+	if err != nil {
+		return nil, err
+	}
+	finish, err := parseGraphiteTime(until, now)
+	if err != nil {
+		return nil, err
+	}
+
+	qs := url.Values{}
+	qs.Set("start", strconv.FormatInt(start, 10))
+	qs.Set("finish", strconv.FormatInt(finish, 10))
+	return qs, nil
+}
+
+// fetchGraphite fetches all series under the literal prefix of a Graphite
+// path pattern from the target that owns the host. If the fetch fails, the
+// error is served to the client and ok is false.
+func fetchGraphite(w http.ResponseWriter, config coco.FetchConfig, tiers *[]coco.Tier, pattern []string, qs url.Values) (series []Series, ok bool) {
+	if len(pattern) == 0 || len(pattern[0]) == 0 || isPattern(pattern[0]) {
+		err := errors.New("graphite paths must start with a literal hostname")
+		writeError(w, http.StatusBadRequest, err, "", "")
+		return nil, false
+	}
+	host := visageHost(pattern[0])
+
+	// Ask Visage for as little as possible
+	parts := []string{"/data", host}
+	for _, component := range pattern[1:] {
+		if len(parts) == 4 || isPattern(component) {
+			break
+		}
+		parts = append(parts, component)
+	}
+	uri := strings.Join(parts, "/") + "?" + qs.Encode()
+
+	u := proxy(w, config, tiers, host, uri)
+	if u == nil {
+		return nil, false
+	}
+	defer u.Resp.Body.Close()
+
+	all, err := decode(u.Resp, qs)
+	if err != nil {
+		tierFailureCounts.Add(u.Tier, 1)
+		writeError(w, statusForError(err), err, u.Tier, u.Target)
+		return nil, false
+	}
+	var proxied int64
+	if u.Resp.ContentLength > 0 {
+		proxied = u.Resp.ContentLength
+	}
+	u.done(proxied)
+
+	for _, s := range all {
+		if matches(graphitePath(s), pattern) {
+			series = append(series, s)
+		}
+	}
+	return series, true
+}
+
+func writeGraphite(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't marshal graphite response for client: %s\n", err)
+		errorCounts.Add("fetch.json.marshal", 1)
+		writeError(w, http.StatusInternalServerError, err, "", "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+	respCounts.Add(strconv.Itoa(http.StatusOK), 1)
+}
+
+// Render implements Graphite's /render API, for JSON output
+func Render(w http.ResponseWriter, req *http.Request, config coco.FetchConfig, tiers *[]coco.Tier) {
+	req.ParseForm()
+	if format := req.Form.Get("format"); len(format) > 0 && format != "json" {
+		err := fmt.Errorf("unsupported format '%s'", format)
+		writeError(w, http.StatusBadRequest, err, "", "")
+		return
+	}
+	qs, err := graphiteWindow(req.Form)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err, "", "")
+		return
+	}
+
+	result := []GraphiteSeries{}
+	for _, target := range req.Form["target"] {
+		series, ok := fetchGraphite(w, config, tiers, strings.Split(target, "."), qs)
+		if !ok {
+			return
+		}
+		for _, s := range series {
+			datapoints := make([]Datapoint, len(s.Points))
+			for i, p := range s.Points {
+				datapoints[i] = Datapoint(p)
+			}
+			result = append(result, GraphiteSeries{
+				Target:     strings.Join(graphitePath(s), "."),
+				Datapoints: datapoints,
+			})
+		}
+	}
+
+	writeGraphite(w, result)
+}
+
+// Find implements Graphite's /metrics/find API, for JSON output
+func Find(w http.ResponseWriter, req *http.Request, config coco.FetchConfig, tiers *[]coco.Tier) {
+	req.ParseForm()
+	pattern := strings.Split(req.Form.Get("query"), ".")
+	nodes := []GraphiteNode{}
+
+	// Hosts can't be enumerated, so only a literal host can be found
+	if len(pattern) == 1 {
+		if len(pattern[0]) > 0 && !isPattern(pattern[0]) {
+			nodes = append(nodes, GraphiteNode{Text: pattern[0], Id: pattern[0], Expandable: 1, AllowChildren: 1})
+		}
+		writeGraphite(w, nodes)
+		return
+	}
+	if len(pattern) > 4 {
+		writeGraphite(w, nodes)
+		return
+	}
+
+	// Only fetch a small window, as we only care about the names
+	qs := url.Values{}
+	qs.Set("start", strconv.FormatInt(time.Now().Unix()-600, 10))
+	series, ok := fetchGraphite(w, config, tiers, pattern, qs)
+	if !ok {
+		return
+	}
+
+	// Collect the distinct names at the depth of the query
+	depth := len(pattern) - 1
+	leaf := depth == 3
+	seen := map[string]bool{}
+	for _, s := range series {
+		components := graphitePath(s)[:depth+1]
+		id := strings.Join(components, ".")
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		node := GraphiteNode{Text: components[depth], Id: id}
+		if leaf {
+			node.Leaf = 1
+		} else {
+			node.Expandable = 1
+			node.AllowChildren = 1
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Sort(byId(nodes))
+
+	writeGraphite(w, nodes)
+}
+
+type byId []GraphiteNode
+
+func (n byId) Len() int           { return len(n) }
+func (n byId) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n byId) Less(i, j int) bool { return n[i].Id < n[j].Id }
@@ -7,114 +7,258 @@ import (
 	"fmt"
 	"github.com/bulletproofnetworks/coco/coco"
 	"github.com/go-martini/martini"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
 type ErrorJSON struct {
-	Msg string `json:"error"`
+	Msg    string `json:"error"`
+	Tier   string `json:"tier,omitempty"`
+	Target string `json:"target,omitempty"`
 }
 
-func errorJSON(err error) []byte {
+func errorJSON(err error, tier string, target string) []byte {
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "%+v", err)
-	errResp := ErrorJSON{Msg: buf.String()}
+	errResp := ErrorJSON{Msg: buf.String(), Tier: tier, Target: target}
 	e, _ := json.Marshal(errResp)
 	return e
 }
 
+// writeError serves an ErrorJSON to the client with the given status code
+func writeError(w http.ResponseWriter, code int, err error, tier string, target string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(errorJSON(err, tier, target))
+	respCounts.Add(strconv.Itoa(code), 1)
+}
+
+// statusForError determines the status code to serve when a request to a
+// target fails: 504 if the target timed out, 502 for everything else.
+func statusForError(err error) int {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// metaHeader builds the name of the response header a piece of routing
+// metadata is exposed under, e.g. "target" becomes "X-Coco-Target".
+func metaHeader(key string) string {
+	return "X-Coco-" + strings.Title(key)
+}
+
+// stream pipes the target's response body through to the client unmodified.
+func stream(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	if ct := resp.Header.Get("Content-Type"); len(ct) > 0 {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(resp.StatusCode)
+	return io.Copy(w, resp.Body)
+}
+
+// rewrite reads the target's JSON response body and injects the routing
+// metadata under the "_meta" key.
+func rewrite(resp *http.Response, meta map[string]string) ([]byte, error) {
+	// Read the body, check for any errors
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't read response from target: %s\n", err)
+		defer func() { errorCounts.Add("fetch.ioutil.readall", 1) }()
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't unmarshal JSON from target: %s\n", err)
+		defer func() { errorCounts.Add("fetch.json.unmarshal", 1) }()
+		return nil, err
+	}
+	data["_meta"] = meta
+	bm, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't re-marshal target JSON for client: %s\n", err)
+		defer func() { errorCounts.Add("fetch.json.marshal", 1) }()
+		return nil, err
+	}
+	return bm, nil
+}
+
+// upstream is a request proxied to the target that owns a host's metrics
+type upstream struct {
+	Tier   string
+	Target string
+	Meta   map[string]string
+	Resp   *http.Response
+}
+
+// done tracks metrics for a successful proxy request
+func (u *upstream) done(proxied int64) {
+	reqCounts.Add(u.Target, 1) // the target in the hash we proxied to
+	reqCounts.Add("total", 1)
+	bytesProxied.Add(proxied)
+	tierCounts.Add(u.Tier, 1)
+	if u.Resp.StatusCode < 400 {
+		tierSuccessCounts.Add(u.Tier, 1)
+	} else {
+		tierFailureCounts.Add(u.Tier, 1)
+	}
+}
+
+// proxy looks up the target that owns a host's metrics in the first tier that
+// can route the host, and performs a GET for uri against it. Routing metadata
+// is exposed in the response headers. If the GET can't be performed, or the
+// target returns an error, an error is served to the client and nil is
+// returned.
+//
+// Every host hashes to a target, so Noodle can't tell if a host exists. A
+// host the target has no metrics for is served as the target's own 404.
+func proxy(w http.ResponseWriter, config coco.FetchConfig, tiers *[]coco.Tier, hostname string, uri string) *upstream {
+	for _, tier := range *tiers {
+		// Lookup the hostname in the tier's hash. Work out where we should proxy to.
+		target, err := tier.Lookup(hostname)
+		if err != nil {
+			log.Printf("[info] Fetch: couldn't lookup target: %s\n", err)
+			errorCounts.Add("fetch.con.get", 1)
+			tierFailureCounts.Add(tier.Name, 1)
+			continue
+		}
+
+		// Construct the URL, and do the GET
+		host, url := tier.FetchURL(target, config.RemotePort, uri)
+		client := &http.Client{Timeout: config.Timeout()}
+		resp, err := client.Get(url)
+		if err != nil {
+			log.Printf("[info] Fetch: couldn't perform GET to target: %s\n", err)
+			writeError(w, statusForError(err), err, tier.Name, target)
+			errorCounts.Add("fetch.http.get", 1)
+			tierFailureCounts.Add(tier.Name, 1)
+			return nil
+		}
+
+		// Expose metadata about the proxied request in the headers
+		meta := map[string]string{
+			"host":   host,
+			"target": target,
+			"url":    url,
+			"tier":   tier.Name,
+		}
+		for k, v := range meta {
+			w.Header().Set(metaHeader(k), v)
+		}
+
+		// Pass through errors from the target, rather than trying to parse them
+		if resp.StatusCode >= 400 {
+			resp.Body.Close()
+			err := fmt.Errorf("target returned %s", resp.Status)
+			writeError(w, resp.StatusCode, err, tier.Name, target)
+			tierFailureCounts.Add(tier.Name, 1)
+			return nil
+		}
+
+		return &upstream{Tier: tier.Name, Target: target, Meta: meta, Resp: resp}
+	}
+
+	// No tier could route the host
+	err := fmt.Errorf("no tier could route host '%s'", hostname)
+	writeError(w, http.StatusNotFound, err, "", "")
+	return nil
+}
+
 func Fetch(config coco.FetchConfig, tiers *[]coco.Tier) {
 	// Initialise the error counts
 	errorCounts.Add("fetch.con.get", 0)
 	errorCounts.Add("fetch.http.get", 0)
 	errorCounts.Add("fetch.ioutil.readall", 0)
+	errorCounts.Add("fetch.io.copy", 0)
+	errorCounts.Add("fetch.query.translate", 0)
 
 	if len(config.Bind) == 0 {
 		log.Fatal("[fatal] Fetch: No address configured to bind web server.")
 	}
+	if err := config.ValidateMode(); err != nil {
+		log.Fatalf("[fatal] Fetch: %s", err)
+	}
 
 	coco.BuildTiers(tiers)
 
 	m := martini.Classic()
-	m.Get("/data/:hostname/(.+)", func(params martini.Params, req *http.Request) []byte {
-		for _, tier := range *tiers {
-			// Lookup the hostname in the tier's hash. Work out where we should proxy to.
-			target, err := tier.Lookup(params["hostname"])
-			if err != nil {
-				log.Printf("[info] Fetch: couldn't lookup target: %s\n", err)
-				defer func() { errorCounts.Add("fetch.con.get", 1) }()
-				return errorJSON(err)
-			}
-
-			// Construct the URL, and do the GET
-			var host string
-			if len(config.RemotePort) > 0 {
-				// FIXME(lindsay) look up fetch port per-target?
-				host = strings.Split(target, ":")[0] + ":" + config.RemotePort
-			} else {
-				host = strings.Split(target, ":")[0]
-			}
-			url := "http://" + host + req.RequestURI
-			client := &http.Client{Timeout: config.Timeout()}
-			resp, err := client.Get(url)
-			defer resp.Body.Close()
-			if err != nil {
-				log.Printf("[info] Fetch: couldn't perform GET to target: %s\n", err)
-				defer func() { errorCounts.Add("fetch.http.get", 1) }()
-				return errorJSON(err)
-			}
-
-			// TODO(lindsay): count successful requests to each tier
-			// TODO(lindsay): count failed requests to each tier
+	m.Get("/data/:hostname/(.+)", func(params martini.Params, w http.ResponseWriter, req *http.Request) {
+		u := proxy(w, config, tiers, params["hostname"], req.RequestURI)
+		if u == nil {
+			return
+		}
+		defer u.Resp.Body.Close()
 
-			// Read the body, check for any errors
-			body, err := ioutil.ReadAll(resp.Body)
+		var proxied int64
+		var err error
+		if config.Streaming() {
+			// Pipe the body and status straight through to the client
+			proxied, err = stream(w, u.Resp)
 			if err != nil {
-				log.Printf("[info] Fetch: couldn't read response from target: %s\n", err)
-				defer func() { errorCounts.Add("fetch.ioutil.readall", 1) }()
-				return errorJSON(err)
+				log.Printf("[info] Fetch: couldn't stream response from target: %s\n", err)
+				defer func() {
+					errorCounts.Add("fetch.io.copy", 1)
+					tierFailureCounts.Add(u.Tier, 1)
+				}()
+				return
 			}
-
+			respCounts.Add(strconv.Itoa(u.Resp.StatusCode), 1)
+		} else {
 			// Stuff in metadata about the proxied request
-			meta := map[string]string{
-				"host":   host,
-				"target": target,
-				"url":    url,
-			}
-			var data map[string]interface{}
-			err = json.Unmarshal(body, &data)
+			bm, err := rewrite(u.Resp, u.Meta)
 			if err != nil {
-				log.Printf("[info] Fetch: couldn't unmarshal JSON from target: %s\n", err)
-				defer func() { errorCounts.Add("fetch.json.unmarshal", 1) }()
-				return errorJSON(err)
-			}
-			data["_meta"] = meta
-			bm, err := json.Marshal(data)
-			if err != nil {
-				log.Printf("[info] Fetch: couldn't re-marshal target JSON for client: %s\n", err)
-				defer func() { errorCounts.Add("fetch.json.marshal", 1) }()
-				return errorJSON(err)
+				defer func() { tierFailureCounts.Add(u.Tier, 1) }()
+				writeError(w, statusForError(err), err, u.Tier, u.Target)
+				return
 			}
+			proxied = int64(len(bm))
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(u.Resp.StatusCode)
+			w.Write(bm)
+			respCounts.Add(strconv.Itoa(u.Resp.StatusCode), 1)
+		}
 
-			// Track metrics for a successful proxy request
-			defer func() {
-				reqCounts.Add(target, 1) // the target in the hash we proxied to
-				reqCounts.Add("total", 1)
-				respCounts.Add(strconv.Itoa(resp.StatusCode), 1)
-				bytesProxied.Add(resp.ContentLength)
-				tierCounts.Add(tier.Name, 1)
-			}()
-
-			// return the body with metadata
-			return bm
+		// Track metrics for a successful proxy request
+		defer u.done(proxied)
+	})
+	// Serve series in a normalised format, independent of Visage's JSON
+	m.Get("/query/:hostname/(.+)", func(params martini.Params, w http.ResponseWriter, req *http.Request) {
+		uri := "/data" + strings.TrimPrefix(req.RequestURI, "/query")
+		u := proxy(w, config, tiers, params["hostname"], uri)
+		if u == nil {
+			return
+		}
+		defer u.Resp.Body.Close()
+
+		body, err := query(u.Resp, req.URL.Query())
+		if err != nil {
+			defer func() { tierFailureCounts.Add(u.Tier, 1) }()
+			writeError(w, statusForError(err), err, u.Tier, u.Target)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(body)
+		respCounts.Add(strconv.Itoa(http.StatusOK), 1)
 
-		// TODO(lindsay): Provide a fallback response if there is no data available
-		// return the body
-		return []byte("oops")
+		// Track metrics for a successful proxy request
+		defer u.done(int64(len(body)))
+	})
+	// Serve series to clients that speak Graphite's API, e.g. Grafana
+	m.Get("/render", func(w http.ResponseWriter, req *http.Request) {
+		Render(w, req, config, tiers)
+	})
+	m.Post("/render", func(w http.ResponseWriter, req *http.Request) {
+		Render(w, req, config, tiers)
+	})
+	m.Get("/metrics/find", func(w http.ResponseWriter, req *http.Request) {
+		Find(w, req, config, tiers)
 	})
 	// Implement expvars.expvarHandler in Martini.
 	m.Get("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
@@ -129,9 +273,11 @@ func Fetch(config coco.FetchConfig, tiers *[]coco.Tier) {
 }
 
 var (
-	tierCounts   = expvar.NewMap("noodle.fetch.tier.requests")
-	reqCounts    = expvar.NewMap("noodle.fetch.target.requests")
-	respCounts   = expvar.NewMap("noodle.fetch.target.response.codes")
-	bytesProxied = expvar.NewInt("noodle.fetch.bytes.proxied")
-	errorCounts  = expvar.NewMap("noodle.errors")
+	tierCounts        = expvar.NewMap("noodle.fetch.tier.requests")
+	tierSuccessCounts = expvar.NewMap("noodle.fetch.tier.success")
+	tierFailureCounts = expvar.NewMap("noodle.fetch.tier.failure")
+	reqCounts         = expvar.NewMap("noodle.fetch.target.requests")
+	respCounts        = expvar.NewMap("noodle.fetch.target.response.codes")
+	bytesProxied      = expvar.NewInt("noodle.fetch.bytes.proxied")
+	errorCounts       = expvar.NewMap("noodle.errors")
 )
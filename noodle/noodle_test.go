@@ -34,9 +34,39 @@ func MockVisage() {
 		}
 		return b
 	})
+	m.Get("/data/:hostname/:plugin", func(params martini.Params, req *http.Request) []byte {
+		instances := map[string]interface{}{}
+		for _, instance := range []string{"a", "b"} {
+			instances[instance] = map[string]interface{}{
+				"value": map[string]interface{}{
+					"data": make([]float64, 360),
+				},
+			}
+		}
+		resp := map[string]interface{}{
+			params["hostname"]: map[string]interface{}{
+				params["plugin"]: instances,
+			},
+		}
+		b, err := json.Marshal(resp)
+		if err != nil {
+			panic("mockvisage: couldn't encode json")
+		}
+		return b
+	})
 	http.ListenAndServe("127.0.0.1:29292", m)
 }
 
+// MockSlowVisage responds to every request slower than Fetch is willing to wait
+func MockSlowVisage() {
+	m := martini.Classic()
+	m.Get("/data/**", func() []byte {
+		time.Sleep(500 * time.Millisecond)
+		return []byte("{}")
+	})
+	http.ListenAndServe("127.0.0.1:29294", m)
+}
+
 func poll(t *testing.T, address string) {
 	for i := 0; i < 1000; i++ {
 		_, err := net.Dial("tcp", address)
@@ -155,6 +185,291 @@ func TestFetchHasTargetMetadata(t *testing.T) {
 	}
 }
 
+// Test streamed responses carry routing metadata in headers, not the body
+func TestFetchStreaming(t *testing.T) {
+	go MockVisage()
+
+	// Setup Fetch
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26085",
+		ProxyTimeout: *new(coco.Duration),
+		RemotePort:   "29292",
+		Mode:         "stream",
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25887"}}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tiers = append(tiers, tier)
+	}
+
+	go noodle.Fetch(fetchConfig, &tiers)
+
+	poll(t, fetchConfig.Bind)
+
+	// Test
+	resp, err := http.Get("http://127.0.0.1:26085/data/highest/load/load")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+
+	for _, k := range []string{"X-Coco-Target", "X-Coco-Host", "X-Coco-Url", "X-Coco-Tier"} {
+		if resp.Header.Get(k) == "" {
+			t.Errorf("Couldn't find header %s in response: %+v", k, resp.Header)
+		}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	var result map[string]interface{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatalf("Error when decoding JSON %+v. Response body: %s", err, string(body))
+	}
+	if result["_meta"] != nil {
+		t.Errorf("Expected no metadata in streamed body, got: %+v", result["_meta"])
+	}
+	if result["highest"] == nil {
+		t.Errorf("Couldn't find series in streamed body: %s", string(body))
+	}
+}
+
+// Test targets can define their own fetch endpoint
+func TestFetchWithTargetEndpoint(t *testing.T) {
+	go MockVisage()
+
+	// Setup Fetch, with a remote port that will fail if used
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26089",
+		ProxyTimeout: *new(coco.Duration),
+		RemotePort:   "29293",
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{
+		Targets: []string{"127.0.0.1:25887"},
+		Fetch: map[string]coco.EndpointConfig{
+			"127.0.0.1:25887": coco.EndpointConfig{Port: "29292"},
+		},
+	}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets, Endpoints: v.Fetch}
+		tiers = append(tiers, tier)
+	}
+
+	go noodle.Fetch(fetchConfig, &tiers)
+
+	poll(t, fetchConfig.Bind)
+
+	// Test
+	params := visage.Params{
+		Endpoint: fetchConfig.Bind,
+		Host:     "highest",
+		Plugin:   "load",
+		Instance: "load",
+		Ds:       "value",
+		Window:   3 * time.Hour,
+	}
+
+	_, metadata, err := visage.FetchWithMetadata(params)
+	if err != nil {
+		t.Fatalf("Error when fetching Visage data: %s\n", err)
+	}
+	if metadata["host"] != "127.0.0.1:29292" {
+		t.Errorf("Expected fetch from target's endpoint, got: %+v", metadata)
+	}
+}
+
+// Test series can be queried in a normalised format
+func TestQuery(t *testing.T) {
+	go MockVisage()
+
+	// Setup Fetch
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26090",
+		ProxyTimeout: *new(coco.Duration),
+		RemotePort:   "29292",
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25887"}}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tiers = append(tiers, tier)
+	}
+
+	go noodle.Fetch(fetchConfig, &tiers)
+
+	poll(t, fetchConfig.Bind)
+
+	// Test
+	resp, err := http.Get("http://127.0.0.1:26090/query/highest/cpu-0/cpu-user?start=1000&finish=4600")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	var result noodle.QueryJSON
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatalf("Error when decoding JSON %+v. Response body: %s", err, string(body))
+	}
+
+	if len(result.Series) != 1 {
+		t.Fatalf("Expected 1 series, got %d: %s", len(result.Series), string(body))
+	}
+	series := result.Series[0]
+	if series.Host != "highest" || series.Metric != "cpu/0/cpu/user" || series.Ds != "value" {
+		t.Errorf("Unexpected series: %+v", series)
+	}
+	if len(series.Points) != 360 {
+		t.Fatalf("Expected 360 points, got %d", len(series.Points))
+	}
+	if series.Points[0].Timestamp != 1000 || series.Points[1].Timestamp != 1010 {
+		t.Errorf("Unexpected timestamps: %+v, %+v", series.Points[0], series.Points[1])
+	}
+	if series.Points[0].Value == nil || *series.Points[0].Value != 0.0 {
+		t.Errorf("Unexpected value: %+v", series.Points[0])
+	}
+}
+
+// Test series can be rendered through Graphite's API
+func TestGraphiteRender(t *testing.T) {
+	go MockVisage()
+
+	// Setup Fetch
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26091",
+		ProxyTimeout: *new(coco.Duration),
+		RemotePort:   "29292",
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25887"}}
+
+	var tiers []coco.Tier
+	for k, v := range tierConfig {
+		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tiers = append(tiers, tier)
+	}
+
+	go noodle.Fetch(fetchConfig, &tiers)
+
+	poll(t, fetchConfig.Bind)
+
+	// Test render
+	resp, err := http.Get("http://127.0.0.1:26091/render?target=host_example_org.load.*.value&from=-1h&format=json")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	var result []map[string]interface{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		t.Fatalf("Error when decoding JSON %+v. Response body: %s", err, string(body))
+	}
+
+	expected := []string{"host_example_org.load.a.value", "host_example_org.load.b.value"}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d series, got %d: %s", len(expected), len(result), string(body))
+	}
+	for i, series := range result {
+		if series["target"] != expected[i] {
+			t.Errorf("Expected target %s, got %s", expected[i], series["target"])
+		}
+		datapoints := series["datapoints"].([]interface{})
+		if len(datapoints) != 360 {
+			t.Fatalf("Expected 360 datapoints, got %d", len(datapoints))
+		}
+		datapoint := datapoints[0].([]interface{})
+		if datapoint[0].(float64) != 0.0 || datapoint[1].(float64) == 0.0 {
+			t.Errorf("Expected [value, timestamp] datapoint, got %+v", datapoint)
+		}
+	}
+
+	// Test find
+	resp, err = http.Get("http://127.0.0.1:26091/metrics/find?query=host_example_org.load.*")
+	if err != nil {
+		t.Fatalf("HTTP GET failed: %s", err)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	var nodes []noodle.GraphiteNode
+	err = json.Unmarshal(body, &nodes)
+	if err != nil {
+		t.Fatalf("Error when decoding JSON %+v. Response body: %s", err, string(body))
+	}
+
+	expected = []string{"host_example_org.load.a", "host_example_org.load.b"}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %d nodes, got %d: %s", len(expected), len(nodes), string(body))
+	}
+	for i, node := range nodes {
+		if node.Id != expected[i] || node.Leaf != 0 || node.Expandable != 1 {
+			t.Errorf("Expected expandable node %s, got %+v", expected[i], node)
+		}
+	}
+}
+
+// Test hostnames with underscores are fetched intact through Graphite's API
+func TestGraphiteUnderscoreHost(t *testing.T) {
+	// Record the hostnames requested from Visage
+	hosts := make(chan string, 10)
+	m := martini.Classic()
+	m.Get("/data/:hostname/:plugin", func(params martini.Params) []byte {
+		hosts <- params["hostname"]
+		return []byte("{}")
+	})
+	go http.ListenAndServe("127.0.0.1:29295", m)
+
+	// Setup Fetch
+	fetchConfig := coco.FetchConfig{
+		Bind:         "127.0.0.1:26094",
+		ProxyTimeout: *new(coco.Duration),
+		RemotePort:   "29295",
+	}
+	fetchConfig.ProxyTimeout.UnmarshalText([]byte("3s"))
+
+	tiers := []coco.Tier{coco.Tier{Name: "a", Targets: []string{"127.0.0.1:25887"}}}
+	go noodle.Fetch(fetchConfig, &tiers)
+
+	poll(t, fetchConfig.Bind)
+	poll(t, "127.0.0.1:29295")
+
+	// Test
+	paths := map[string]string{
+		"/metrics/find?query=web__01_example_org.load.*":         "web_01.example.org",
+		"/render?target=db__2.load.*.value&from=-1h&format=json": "db_2",
+		"/metrics/find?query=host_example_org.load.*":            "host.example.org",
+	}
+	for path, expected := range paths {
+		resp, err := http.Get("http://" + fetchConfig.Bind + path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %s", err)
+		}
+		resp.Body.Close()
+		select {
+		case host := <-hosts:
+			if host != expected {
+				t.Errorf("Expected %s to fetch host %s, got %s", path, expected, host)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %s to fetch host %s, got nothing", path, expected)
+		}
+	}
+}
+
 // Test a bad fetch results in an error
 func TestFetchWithFailure(t *testing.T) {
 	go MockVisage()
@@ -198,6 +513,69 @@ func TestFetchWithFailure(t *testing.T) {
 	}
 }
 
+// Test failed fetches are served with meaningful status codes and errors
+func TestFetchStatusCodes(t *testing.T) {
+	go MockVisage()
+	go MockSlowVisage()
+
+	tierConfig := make(map[string]coco.TierConfig)
+	tierConfig["a"] = coco.TierConfig{Targets: []string{"127.0.0.1:25887"}}
+
+	// Setup a Fetch for each upstream behaviour we want to exercise
+	cases := []struct {
+		bind   string
+		port   string
+		mode   string
+		path   string
+		status int
+	}{
+		{"127.0.0.1:26086", "29293", "", "/data/highest/load/load", http.StatusBadGateway},
+		{"127.0.0.1:26087", "29294", "", "/data/highest/load/load", http.StatusGatewayTimeout},
+		{"127.0.0.1:26088", "29292", "", "/data/highest/load/load/extra", http.StatusNotFound},
+		// Hosts the target has no metrics for are the target's 404
+		{"127.0.0.1:26092", "29292", "stream", "/data/highest/load/load/extra", http.StatusNotFound},
+		{"127.0.0.1:26093", "29292", "", "/query/highest/load/load/extra", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		fetchConfig := coco.FetchConfig{
+			Bind:         c.bind,
+			ProxyTimeout: *new(coco.Duration),
+			RemotePort:   c.port,
+			Mode:         c.mode,
+		}
+		fetchConfig.ProxyTimeout.UnmarshalText([]byte("100ms"))
+
+		var tiers []coco.Tier
+		for k, v := range tierConfig {
+			tier := coco.Tier{Name: k, Targets: v.Targets}
+			tiers = append(tiers, tier)
+		}
+
+		go noodle.Fetch(fetchConfig, &tiers)
+		poll(t, fetchConfig.Bind)
+
+		// Test
+		resp, err := http.Get("http://" + c.bind + c.path)
+		if err != nil {
+			t.Fatalf("HTTP GET failed: %s", err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("Expected status %d from %s, got %d", c.status, c.bind, resp.StatusCode)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		var result noodle.ErrorJSON
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatalf("Error when decoding JSON %+v. Response body: %s", err, string(body))
+		}
+		if result.Msg == "" || result.Tier != "a" || result.Target != "127.0.0.1:25887" {
+			t.Errorf("Expected error with tier and target, got: %s", string(body))
+		}
+	}
+}
+
 // Test the lookup function for determining where a metric is stored
 func TestTierLookup(t *testing.T) {
 	// Setup Fetch
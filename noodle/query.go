@@ -0,0 +1,234 @@
+package noodle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bulletproofnetworks/coco/coco"
+	collectd "github.com/kimor79/gollectd"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryJSON is the normalised response served by the query endpoint
+type QueryJSON struct {
+	Series []Series `json:"series"`
+}
+
+// Series is the data for a single data source of a metric
+type Series struct {
+	Host   string  `json:"host"`
+	Metric string  `json:"metric"`
+	Ds     string  `json:"ds"`
+	Points []Point `json:"points"`
+
+	// The names Visage knows the series by
+	plugin   string
+	instance string
+}
+
+// Point is a value at a point in time. Value is nil if there is no data.
+type Point struct {
+	Timestamp int64
+	Value     *float64
+}
+
+// MarshalJSON encodes a Point as a [timestamp, value] pair
+func (p Point) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{p.Timestamp, p.Value})
+}
+
+// UnmarshalJSON decodes a Point from a [timestamp, value] pair
+func (p *Point) UnmarshalJSON(b []byte) error {
+	var pair []*float64
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 || pair[0] == nil {
+		return fmt.Errorf("malformed point: %s", b)
+	}
+	p.Timestamp = int64(*pair[0])
+	p.Value = pair[1]
+	return nil
+}
+
+// splitName splits a Visage plugin or instance name into its name and
+// instance parts, e.g. "cpu-0" becomes "cpu" and "0".
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// metricName builds the metric name Coco would give to a Visage plugin and
+// instance, so series can be matched against Coco's routes.
+func metricName(plugin string, instance string) string {
+	var packet collectd.Packet
+	packet.Plugin, packet.PluginInstance = splitName(plugin)
+	packet.Type, packet.TypeInstance = splitName(instance)
+	return coco.MetricName(packet)
+}
+
+func asMap(v interface{}, what string) (map[string]interface{}, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s in JSON from target: %+v", what, v)
+	}
+	return m, nil
+}
+
+// window determines the time range a Visage data source covers. Visage
+// provides "start" and "finish" with the data, but if it doesn't we fall
+// back to what the client asked for.
+func window(ds map[string]interface{}, qs url.Values) (start int64, finish int64) {
+	finish = time.Now().Unix()
+	if v, err := strconv.ParseInt(qs.Get("start"), 10, 64); err == nil {
+		start = v
+	}
+	if v, err := strconv.ParseInt(qs.Get("finish"), 10, 64); err == nil {
+		finish = v
+	}
+	if v, ok := ds["start"].(float64); ok {
+		start = int64(v)
+	}
+	if v, ok := ds["finish"].(float64); ok {
+		finish = int64(v)
+	}
+	return start, finish
+}
+
+// translate converts Visage's nested host/plugin/instance/ds/data JSON into
+// a flat list of series.
+func translate(data map[string]interface{}, qs url.Values) ([]Series, error) {
+	if val, ok := data["error"]; ok {
+		return nil, fmt.Errorf("%v", val)
+	}
+
+	series := []Series{}
+	for host, p := range data {
+		if host == "_meta" {
+			continue
+		}
+		plugins, err := asMap(p, "plugins")
+		if err != nil {
+			return nil, err
+		}
+		for plugin, i := range plugins {
+			instances, err := asMap(i, "instances")
+			if err != nil {
+				return nil, err
+			}
+			for instance, d := range instances {
+				dses, err := asMap(d, "data sources")
+				if err != nil {
+					return nil, err
+				}
+				for name, v := range dses {
+					ds, err := asMap(v, "data source")
+					if err != nil {
+						return nil, err
+					}
+					values, ok := ds["data"].([]interface{})
+					if !ok {
+						return nil, errors.New("data source has no data in JSON from target")
+					}
+
+					// Spread the values evenly across the window
+					start, finish := window(ds, qs)
+					var step int64
+					if len(values) > 0 {
+						step = (finish - start) / int64(len(values))
+					}
+					points := make([]Point, len(values))
+					for n, value := range values {
+						points[n].Timestamp = start + int64(n)*step
+						if vf, ok := value.(float64); ok {
+							points[n].Value = &vf
+						}
+					}
+
+					series = append(series, Series{
+						Host:   host,
+						Metric: metricName(plugin, instance),
+						Ds:     name,
+						Points: points,
+
+						plugin:   plugin,
+						instance: instance,
+					})
+				}
+			}
+		}
+	}
+
+	// Provide a stable ordering for clients
+	sort.Sort(byName(series))
+	return series, nil
+}
+
+type byName []Series
+
+func (s byName) Len() int      { return len(s) }
+func (s byName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool {
+	if s[i].Host != s[j].Host {
+		return s[i].Host < s[j].Host
+	}
+	if s[i].Metric != s[j].Metric {
+		return s[i].Metric < s[j].Metric
+	}
+	return s[i].Ds < s[j].Ds
+}
+
+// decode reads the target's Visage JSON response body and translates it into
+// a list of series.
+func decode(resp *http.Response, qs url.Values) ([]Series, error) {
+	// Read the body, check for any errors
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't read response from target: %s\n", err)
+		errorCounts.Add("fetch.ioutil.readall", 1)
+		return nil, err
+	}
+
+	var data map[string]interface{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't unmarshal JSON from target: %s\n", err)
+		errorCounts.Add("fetch.json.unmarshal", 1)
+		return nil, err
+	}
+
+	series, err := translate(data, qs)
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't translate JSON from target: %s\n", err)
+		errorCounts.Add("fetch.query.translate", 1)
+		return nil, err
+	}
+	return series, nil
+}
+
+// query reads the target's Visage JSON response body and translates it into
+// the normalised query format.
+func query(resp *http.Response, qs url.Values) ([]byte, error) {
+	series, err := decode(resp, qs)
+	if err != nil {
+		return nil, err
+	}
+
+	bm, err := json.Marshal(QueryJSON{Series: series})
+	if err != nil {
+		log.Printf("[info] Fetch: couldn't marshal series for client: %s\n", err)
+		errorCounts.Add("fetch.json.marshal", 1)
+		return nil, err
+	}
+	return bm, nil
+}
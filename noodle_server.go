@@ -24,7 +24,7 @@ func main() {
 
 	var tiers []coco.Tier
 	for k, v := range config.Tiers {
-		tier := coco.Tier{Name: k, Targets: v.Targets}
+		tier := coco.Tier{Name: k, Targets: v.Targets, Endpoints: v.Fetch}
 		tiers = append(tiers, tier)
 	}
 